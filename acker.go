@@ -0,0 +1,179 @@
+package cmq_go
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// AckError 重试后仍然无法删除的消息句柄，这些消息会在可见性超时后重新投递
+type AckError struct {
+	ReceiptHandles []string
+	Err            error
+}
+
+func (this *AckError) Error() string {
+	return fmt.Sprintf("ack %d messages: %v", len(this.ReceiptHandles), this.Err)
+}
+
+// Acker 累积处理成功的消息句柄，通过 BatchDeleteMessage 批量删除。
+// 达到 BatchSize、等待超过 Interval 或最早的消息距离可见性超时不足 Margin 时刷新
+type Acker struct {
+	queue *Queue
+
+	/** 每次批量删除的句柄数，最多16，默认16 */
+	BatchSize int
+	/** 句柄最长的累积时间，默认1秒 */
+	Interval time.Duration
+	/** 距离消息重新可见的安全时间，默认2秒 */
+	Margin time.Duration
+	/** 删除失败后的重试次数，默认3 */
+	MaxRetries int
+	/** 无法删除的句柄回调 */
+	OnFailure func(err *AckError)
+
+	mu      sync.Mutex
+	pending []pendingAck
+	kick    chan struct{}
+}
+
+type pendingAck struct {
+	receiptHandle string
+	deadline      time.Time
+}
+
+func NewAcker(queue *Queue) *Acker {
+	return &Acker{
+		queue:      queue,
+		BatchSize:  16,
+		Interval:   time.Second,
+		Margin:     2 * time.Second,
+		MaxRetries: 3,
+		kick:       make(chan struct{}, 1),
+	}
+}
+
+func (this *Acker) batchSize() int {
+	if this.BatchSize <= 0 || this.BatchSize > 16 {
+		return 16
+	}
+	return this.BatchSize
+}
+
+// Ack 记录待删除的消息，需要在 Run 运行期间调用
+func (this *Acker) Ack(msg Message) {
+	deadline := time.Now().Add(this.Interval)
+	if msg.NextVisibleTime > 0 {
+		visible := time.Unix(0, msg.NextVisibleTime*int64(time.Millisecond)).Add(-this.Margin)
+		if visible.Before(deadline) {
+			deadline = visible
+		}
+	}
+	this.mu.Lock()
+	// Run 按最早的截止时间等待，新句柄的截止时间更早时需要唤醒它重新计算
+	earlier := len(this.pending) == 0 || deadline.Before(this.earliest())
+	this.pending = append(this.pending, pendingAck{receiptHandle: msg.ReceiptHandle, deadline: deadline})
+	full := len(this.pending) >= this.batchSize()
+	this.mu.Unlock()
+	if full || earlier {
+		select {
+		case this.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Run 按批量和时间条件刷新，ctx取消时删除剩余的句柄后返回
+func (this *Acker) Run(ctx context.Context) error {
+	for {
+		this.mu.Lock()
+		wait := this.Interval
+		if len(this.pending) > 0 {
+			wait = time.Until(this.earliest())
+		}
+		this.mu.Unlock()
+
+		if wait > 0 {
+			t := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				this.Flush(context.Background())
+				return ctx.Err()
+			case <-this.kick:
+			case <-t.C:
+			}
+			t.Stop()
+		}
+		// 删除进行中时ctx被取消不应中断删除，否则这些句柄既不会被删除也不会留给最后的 Flush
+		this.flush(context.WithoutCancel(ctx), false)
+	}
+}
+
+func (this *Acker) earliest() time.Time {
+	earliest := this.pending[0].deadline
+	for _, p := range this.pending[1:] {
+		if p.deadline.Before(earliest) {
+			earliest = p.deadline
+		}
+	}
+	return earliest
+}
+
+// Flush 立即删除所有累积的句柄
+func (this *Acker) Flush(ctx context.Context) error {
+	return this.flush(ctx, true)
+}
+
+func (this *Acker) flush(ctx context.Context, all bool) error {
+	this.mu.Lock()
+	var batches [][]string
+	size := this.batchSize()
+	for len(this.pending) > 0 {
+		if !all && len(this.pending) < size && this.earliest().After(time.Now()) {
+			break
+		}
+		n := len(this.pending)
+		if n > size {
+			n = size
+		}
+		batch := make([]string, n)
+		for i := range batch {
+			batch[i] = this.pending[i].receiptHandle
+		}
+		batches = append(batches, batch)
+		this.pending = this.pending[n:]
+	}
+	this.mu.Unlock()
+
+	var firstErr error
+	for _, batch := range batches {
+		if err := this.delete(ctx, batch); err != nil {
+			if this.OnFailure != nil {
+				this.OnFailure(err)
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+func (this *Acker) delete(ctx context.Context, receiptHandles []string) *AckError {
+	var err error
+	for attempt := 0; attempt <= this.MaxRetries; attempt++ {
+		if attempt > 0 {
+			sleepContext(ctx, time.Duration(attempt)*100*time.Millisecond)
+		}
+		if receiptHandles, err = this.queue.batchDeleteMessage(ctx, receiptHandles); err == nil {
+			return nil
+		}
+		if _, ok := err.(*CommResp); ok {
+			// 句柄已失效等业务错误重试无意义
+			break
+		}
+	}
+	return &AckError{ReceiptHandles: receiptHandles, Err: err}
+}
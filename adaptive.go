@@ -0,0 +1,155 @@
+package cmq_go
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// Adaptive 消费者根据批量接收的填充率、处理耗时和队列的 ActiveMsgNum 在范围内自动调整并发轮询数和每批接收的消息数
+type Adaptive struct {
+	/** 最少并发轮询数，默认1 */
+	MinPollers int
+	/** 最多并发轮询数，默认4，不超过 Consumer.Concurrency */
+	MaxPollers int
+	/** 每批最少接收的消息数，默认1 */
+	MinBatchSize int
+	/** 每批最多接收的消息数，默认16 */
+	MaxBatchSize int
+	/** 采样队列属性和调整的间隔，默认5秒 */
+	Interval time.Duration
+}
+
+type adaptive struct {
+	Adaptive
+
+	// 当前的调整结果
+	pollers   int64
+	batchSize int64
+	backlog   int64
+	latency   int64
+
+	// 本次调整间隔内的统计
+	polls       int64
+	empty       int64
+	requested   int64
+	received    int64
+	handled     int64
+	handleNanos int64
+}
+
+func newAdaptive(conf Adaptive, concurrency, batchSize int) *adaptive {
+	if conf.MinPollers <= 0 {
+		conf.MinPollers = 1
+	}
+	if conf.MaxPollers <= 0 {
+		conf.MaxPollers = 4
+	}
+	// 每个轮询至少占用一个处理位置，多于 Concurrency 的轮询只会等待
+	conf.MaxPollers = clamp(conf.MaxPollers, 1, concurrency)
+	conf.MinPollers = clamp(conf.MinPollers, 1, conf.MaxPollers)
+	if conf.MinBatchSize <= 0 {
+		conf.MinBatchSize = 1
+	}
+	if conf.MaxBatchSize <= 0 || conf.MaxBatchSize > 16 {
+		conf.MaxBatchSize = 16
+	}
+	conf.MinBatchSize = clamp(conf.MinBatchSize, 1, conf.MaxBatchSize)
+	if conf.Interval <= 0 {
+		conf.Interval = 5 * time.Second
+	}
+	return &adaptive{
+		Adaptive:  conf,
+		pollers:   int64(conf.MinPollers),
+		batchSize: int64(clamp(batchSize, conf.MinBatchSize, conf.MaxBatchSize)),
+	}
+}
+
+func (this *adaptive) observePoll(received, requested int) {
+	atomic.AddInt64(&this.polls, 1)
+	atomic.AddInt64(&this.requested, int64(requested))
+	atomic.AddInt64(&this.received, int64(received))
+	if received == 0 {
+		atomic.AddInt64(&this.empty, 1)
+	}
+}
+
+func (this *adaptive) observeHandle(d time.Duration) {
+	atomic.AddInt64(&this.handled, 1)
+	atomic.AddInt64(&this.handleNanos, int64(d))
+}
+
+// run 每个 Interval 采样一次 ActiveMsgNum 并调整，直到ctx取消
+func (this *adaptive) run(ctx context.Context, consumer *Consumer, concurrency int) {
+	ticker := time.NewTicker(this.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if meta, err := consumer.queue.GetQueueAttributes(); err != nil {
+			consumer.report(nil, err)
+		} else {
+			atomic.StoreInt64(&this.backlog, int64(meta.ActiveMsgNum))
+		}
+		this.adjust(concurrency)
+	}
+}
+
+// adjust 根据本次间隔的统计调整轮询数和批量大小：
+// 批量基本收满且仍有堆积时加大批量，大部分为空时减小；
+// 堆积超过一轮能收取的数量且处理能力未饱和时增加轮询，队列空闲或处理能力饱和时减少轮询
+func (this *adaptive) adjust(concurrency int) {
+	polls := atomic.SwapInt64(&this.polls, 0)
+	empty := atomic.SwapInt64(&this.empty, 0)
+	requested := atomic.SwapInt64(&this.requested, 0)
+	received := atomic.SwapInt64(&this.received, 0)
+	handled := atomic.SwapInt64(&this.handled, 0)
+	handleNanos := atomic.SwapInt64(&this.handleNanos, 0)
+
+	backlog := atomic.LoadInt64(&this.backlog)
+	pollers := atomic.LoadInt64(&this.pollers)
+	batchSize := atomic.LoadInt64(&this.batchSize)
+
+	saturated := false
+	if handled > 0 {
+		latency := handleNanos / handled
+		atomic.StoreInt64(&this.latency, latency)
+		// 本次间隔内处理函数最多能处理的消息数
+		capacity := float64(concurrency) * float64(this.Interval) / float64(latency)
+		saturated = float64(received) >= 0.9*capacity
+	}
+
+	if polls > 0 && requested > 0 {
+		fullness := float64(received) / float64(requested)
+		switch {
+		case fullness >= 0.8 && backlog > 0:
+			batchSize *= 2
+		case fullness < 0.25:
+			batchSize /= 2
+		}
+		switch {
+		case fullness >= 0.8 && backlog > pollers*batchSize && !saturated:
+			pollers++
+		case saturated || (backlog == 0 && empty*2 >= polls):
+			pollers--
+		}
+	} else if backlog == 0 {
+		pollers--
+	}
+
+	atomic.StoreInt64(&this.batchSize, int64(clamp(int(batchSize), this.MinBatchSize, this.MaxBatchSize)))
+	atomic.StoreInt64(&this.pollers, int64(clamp(int(pollers), this.MinPollers, this.MaxPollers)))
+}
+
+func clamp(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
@@ -0,0 +1,165 @@
+package cmq_go
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Backpressure 生产端按队列堆积情况限流，堆积数为 ActiveMsgNum+InactiveMsgNum，水位为占 MaxMsgHeapNum 的比例
+type Backpressure struct {
+	/** 队列属性的采样间隔，默认5秒 */
+	Interval time.Duration
+	/** 超过该水位后每次发送前等待 SlowDelay，默认0.8 */
+	SlowWatermark float64
+	/** 超过该水位后阻塞或拒绝发送，默认0.95 */
+	HighWatermark float64
+	/** 减速时每次发送前的等待时间，默认100毫秒 */
+	SlowDelay time.Duration
+	/** 超过高水位时阻塞直到低于高水位(最多 MaxBlock，或ctx取消)，为false时返回 QueueFullError */
+	Block bool
+	/** Block 时最长的阻塞时间，超过后返回 QueueFullError，默认30秒 */
+	MaxBlock time.Duration
+}
+
+// QueueFullError 队列堆积超过高水位，消息没有发送
+type QueueFullError struct {
+	QueueName     string
+	Depth         int
+	MaxMsgHeapNum int
+}
+
+func (this *QueueFullError) Error() string {
+	return fmt.Sprintf("queue %s: depth %d exceeds high watermark of maxMsgHeapNum %d", this.QueueName, this.Depth, this.MaxMsgHeapNum)
+}
+
+// BackpressureStats 限流统计
+type BackpressureStats struct {
+	/** 最近一次采样的堆积数 */
+	Depth int
+	/** 最近一次采样的最大堆积数 */
+	MaxMsgHeapNum int
+	/** 被减速的发送次数 */
+	Slowed int64
+	/** 被阻塞的发送次数 */
+	Blocked int64
+	/** 被拒绝的发送次数，包括阻塞超过 MaxBlock 的 */
+	Rejected int64
+}
+
+type backpressure struct {
+	Backpressure
+
+	mu            sync.Mutex
+	depth         int
+	maxMsgHeapNum int
+	sampled       time.Time
+	fetching      bool
+
+	slowed   int64
+	blocked  int64
+	rejected int64
+}
+
+func newBackpressure(conf Backpressure) *backpressure {
+	if conf.Interval <= 0 {
+		conf.Interval = 5 * time.Second
+	}
+	if conf.SlowWatermark <= 0 {
+		conf.SlowWatermark = 0.8
+	}
+	if conf.HighWatermark <= 0 {
+		conf.HighWatermark = 0.95
+	}
+	if conf.SlowDelay <= 0 {
+		conf.SlowDelay = 100 * time.Millisecond
+	}
+	if conf.MaxBlock <= 0 {
+		conf.MaxBlock = 30 * time.Second
+	}
+	return &backpressure{Backpressure: conf}
+}
+
+func (this *backpressure) stats() BackpressureStats {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return BackpressureStats{
+		Depth:         this.depth,
+		MaxMsgHeapNum: this.maxMsgHeapNum,
+		Slowed:        atomic.LoadInt64(&this.slowed),
+		Blocked:       atomic.LoadInt64(&this.blocked),
+		Rejected:      atomic.LoadInt64(&this.rejected),
+	}
+}
+
+// usage 返回当前堆积占比，采样过期时由一个发送方重新获取队列属性，其他发送方继续使用上一次的结果，
+// 获取失败时同样沿用上一次的结果
+func (this *backpressure) usage(queue *Queue) (depth, max int, ratio float64) {
+	this.mu.Lock()
+	if !this.fetching && time.Since(this.sampled) >= this.Interval {
+		this.fetching = true
+		this.mu.Unlock()
+
+		meta, err := queue.GetQueueAttributes()
+
+		this.mu.Lock()
+		this.fetching = false
+		if err == nil {
+			this.depth = meta.ActiveMsgNum + meta.InactiveMsgNum
+			this.maxMsgHeapNum = meta.MaxMsgHeapNum
+		}
+		this.sampled = time.Now()
+	}
+	depth, max = this.depth, this.maxMsgHeapNum
+	this.mu.Unlock()
+
+	if max <= 0 {
+		return depth, max, 0
+	}
+	return depth, max, float64(depth) / float64(max)
+}
+
+func (this *backpressure) wait(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// admit 在发送前调用，按水位减速、阻塞或拒绝
+func (this *backpressure) admit(ctx context.Context, queue *Queue) error {
+	depth, max, ratio := this.usage(queue)
+	if ratio >= this.HighWatermark {
+		if !this.Block {
+			atomic.AddInt64(&this.rejected, 1)
+			return &QueueFullError{QueueName: queue.queueName, Depth: depth, MaxMsgHeapNum: max}
+		}
+		atomic.AddInt64(&this.blocked, 1)
+		deadline := time.Now().Add(this.MaxBlock)
+		for ratio >= this.HighWatermark {
+			remain := time.Until(deadline)
+			if remain <= 0 {
+				atomic.AddInt64(&this.rejected, 1)
+				return &QueueFullError{QueueName: queue.queueName, Depth: depth, MaxMsgHeapNum: max}
+			}
+			if remain > this.Interval {
+				remain = this.Interval
+			}
+			if err := this.wait(ctx, remain); err != nil {
+				return err
+			}
+			depth, max, ratio = this.usage(queue)
+		}
+	}
+	if ratio >= this.SlowWatermark {
+		atomic.AddInt64(&this.slowed, 1)
+		return this.wait(ctx, this.SlowDelay)
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package cmq_go
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+// ReceiveOptions Queue.Messages 的接收参数
+type ReceiveOptions struct {
+	/** 每次 BatchReceiveMessage 最多接收的消息数，默认16 */
+	BatchSize int
+	/** 长轮询等待时间(秒)，默认10 */
+	PollingWaitSeconds int
+	/** 通道中预取的消息数，默认等于 BatchSize */
+	Prefetch int
+	/** 接收或解码失败时的回调 */
+	OnError func(err error)
+}
+
+// Delivery 从 Queue.Messages 收到的消息，处理完成后需要调用 Ack 或 Nack
+type Delivery struct {
+	Message
+	queue *Queue
+}
+
+// Ack 删除消息
+func (this Delivery) Ack() error {
+	return this.queue.DeleteMessage(this.ReceiptHandle)
+}
+
+// Nack 立即把消息重新发送到队列并删除当前消息，不等待可见性超时。
+// 队列使用信封格式(SetEnvelope 或收到的消息带消息头)时消息头中的 attempt 加1，否则原样发送，以免消费方无法识别信封。
+// 重新发送和删除是两次请求，删除失败时消息会重复，返回删除的错误
+func (this Delivery) Nack() error {
+	var headers map[string]string
+	if this.queue.codec.envelope || this.Headers != nil {
+		headers = make(map[string]string, len(this.Headers)+1)
+		for k, v := range this.Headers {
+			headers[k] = v
+		}
+		headers[HeaderAttempt] = strconv.Itoa(attempts(this.Message) + 1)
+	}
+	if _, err := this.queue.deliver(context.Background(), this.MsgBody, headers, 0); err != nil {
+		return err
+	}
+	return this.queue.DeleteMessage(this.ReceiptHandle)
+}
+
+// Messages 在后台批量接收消息写入返回的通道，ctx取消后关闭通道；
+// 通道中尚未取走的消息不会被删除，在可见性超时后重新投递
+func (this *Queue) Messages(ctx context.Context, opts ReceiveOptions) <-chan Delivery {
+	if opts.BatchSize <= 0 || opts.BatchSize > 16 {
+		opts.BatchSize = 16
+	}
+	if opts.PollingWaitSeconds == 0 {
+		opts.PollingWaitSeconds = 10
+	}
+	if opts.Prefetch <= 0 {
+		opts.Prefetch = opts.BatchSize
+	}
+	ch := make(chan Delivery, opts.Prefetch)
+	go func() {
+		defer close(ch)
+		for ctx.Err() == nil {
+			msgs, err := this.batchReceiveMessage(ctx, opts.BatchSize, opts.PollingWaitSeconds)
+			if err != nil {
+				if ctx.Err() == nil && !isNoMessage(err) {
+					if opts.OnError != nil {
+						opts.OnError(err)
+					}
+					sleepContext(ctx, time.Second)
+				}
+				continue
+			}
+			for i := range msgs {
+				deliver, err := this.prepare(&msgs[i])
+				if !deliver {
+					continue
+				}
+				if err != nil {
+					if opts.OnError != nil {
+						opts.OnError(err)
+					}
+					continue
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case ch <- Delivery{Message: msgs[i], queue: this}:
+				}
+			}
+		}
+	}()
+	return ch
+}
+
+// SinkOptions Queue.Sink 的发送参数
+type SinkOptions struct {
+	/** 未满16条时最长的等待时间，默认100毫秒 */
+	FlushInterval time.Duration
+	/** 发送失败时的回调 */
+	OnError func(msgBodys []string, err error)
+}
+
+// Sink 返回一个通道，写入的消息体在后台通过 BatchSendMessage 批量发送。
+// 调用方关闭通道或ctx取消后，已读取的消息发送完毕即退出；ctx取消后不再读取通道，写入方应同时监听ctx
+func (this *Queue) Sink(ctx context.Context) chan<- string {
+	return this.SinkWithOptions(ctx, SinkOptions{})
+}
+
+func (this *Queue) SinkWithOptions(ctx context.Context, opts SinkOptions) chan<- string {
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = 100 * time.Millisecond
+	}
+	ch := make(chan string, 16)
+	go func() {
+		batch := make([]string, 0, 16)
+		flush := func() {
+			if len(batch) == 0 {
+				return
+			}
+			if _, err := this.BatchSendMessage(batch); err != nil && opts.OnError != nil {
+				opts.OnError(append([]string(nil), batch...), err)
+			}
+			batch = batch[:0]
+		}
+		defer flush()
+
+		timer := time.NewTimer(opts.FlushInterval)
+		defer timer.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msgBody, ok := <-ch:
+				if !ok {
+					return
+				}
+				if len(batch) == 0 {
+					timer.Reset(opts.FlushInterval)
+				}
+				if batch = append(batch, msgBody); len(batch) == 16 {
+					flush()
+				}
+			case <-timer.C:
+				flush()
+			}
+		}
+	}()
+	return ch
+}
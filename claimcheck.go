@@ -0,0 +1,206 @@
+package cmq_go
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 消息体超过阈值时存入BlobStore，消息中只携带引用
+const (
+	HeaderClaimCheck = "claim-check"
+	// 主题消息会投递到多个队列，单个队列删除消息时不能清理共享的数据，需要定期按时间清理(如 FileBlobStore.Purge)
+	HeaderClaimCheckShared = "claim-check-shared"
+)
+
+// DefaultClaimCheckThreshold 预留了信封消息头的空间，低于CMQ 1MB的消息上限
+const DefaultClaimCheckThreshold = 1048576 - 8192
+
+// BlobStore 存储超大消息体，Put返回的引用会随消息发送，接收方通过Get取回
+type BlobStore interface {
+	Put(data []byte) (ref string, err error)
+	Get(ref string) ([]byte, error)
+	Delete(ref string) error
+}
+
+// FileBlobStore 本地目录实现的BlobStore，生产者与消费者需要共享该目录
+type FileBlobStore struct {
+	dir string
+}
+
+func NewFileBlobStore(dir string) (*FileBlobStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileBlobStore{dir: dir}, nil
+}
+
+func (this *FileBlobStore) path(ref string) (string, error) {
+	if ref == "" || strings.ContainsAny(ref, `/\.`) {
+		return "", fmt.Errorf("invalid blob ref %q", ref)
+	}
+	return filepath.Join(this.dir, ref), nil
+}
+
+func (this *FileBlobStore) Put(data []byte) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	ref := hex.EncodeToString(b)
+	name, _ := this.path(ref)
+
+	tmp, err := ioutil.TempFile(this.dir, "tmp-")
+	if err != nil {
+		return "", err
+	}
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return ref, nil
+}
+
+func (this *FileBlobStore) Get(ref string) ([]byte, error) {
+	name, err := this.path(ref)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(name)
+}
+
+func (this *FileBlobStore) Delete(ref string) error {
+	name, err := this.path(ref)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(name); os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Purge 删除写入超过olderThan的数据，返回删除的个数。
+// 主题消息的数据和删除时清理失败的数据不会随消息删除，需要定期调用；olderThan应大于消息的保留时间
+func (this *FileBlobStore) Purge(olderThan time.Duration) (int, error) {
+	entries, err := os.ReadDir(this.dir)
+	if err != nil {
+		return 0, err
+	}
+	cutoff := time.Now().Add(-olderThan)
+	removed := 0
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || info.IsDir() || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		if err = os.Remove(filepath.Join(this.dir, entry.Name())); err == nil {
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+type claimCheck struct {
+	store     BlobStore
+	threshold int
+	shared    bool
+
+	mu sync.Mutex
+	// receiptHandle -> 引用，消息删除成功后清理
+	pending map[string]claimRef
+}
+
+type claimRef struct {
+	ref     string
+	expires time.Time
+}
+
+func (this *claimCheck) put(msgBody string, headers map[string]string) (string, error) {
+	if len(msgBody) <= this.threshold {
+		return msgBody, nil
+	}
+	ref, err := this.store.Put([]byte(msgBody))
+	if err != nil {
+		return "", fmt.Errorf("claim check: %v", err)
+	}
+	headers[HeaderClaimCheck] = ref
+	if this.shared {
+		headers[HeaderClaimCheckShared] = "1"
+	}
+	return "", nil
+}
+
+// resolve 取回消息体并移除引用相关的消息头，返回需要在消息删除后清理的引用(共享数据返回空)。
+// 引用由调用方在整条消息解码成功后登记，解码失败的消息仍指向该数据，不能清理
+func (this *claimCheck) resolve(headers map[string]string) (body, ref string, err error) {
+	ref = headers[HeaderClaimCheck]
+	data, err := this.store.Get(ref)
+	if err != nil {
+		return "", "", fmt.Errorf("claim check %s: %v", ref, err)
+	}
+	_, shared := headers[HeaderClaimCheckShared]
+	delete(headers, HeaderClaimCheck)
+	delete(headers, HeaderClaimCheckShared)
+	if shared {
+		ref = ""
+	}
+	return string(data), ref, nil
+}
+
+func (this *claimCheck) track(receiptHandle, ref string, expires time.Time) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.pending == nil {
+		this.pending = make(map[string]claimRef)
+	}
+	// 句柄过期后消息会以新句柄重新投递，旧记录不再需要
+	if len(this.pending) >= 1024 {
+		now := time.Now()
+		for h, r := range this.pending {
+			if r.expires.Before(now) {
+				delete(this.pending, h)
+			}
+		}
+	}
+	this.pending[receiptHandle] = claimRef{ref: ref, expires: expires}
+}
+
+// forget 不再清理receiptHandle对应的数据，用于删除后仍需保留原始消息的情况
+func (this *claimCheck) forget(receiptHandle string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	delete(this.pending, receiptHandle)
+}
+
+// release 在消息删除成功后清理对应的数据，清理失败不影响删除结果，残留数据需要定期清理(如 FileBlobStore.Purge)
+func (this *claimCheck) release(receiptHandles ...string) {
+	this.mu.Lock()
+	refs := make([]string, 0, len(receiptHandles))
+	for _, h := range receiptHandles {
+		if r, found := this.pending[h]; found {
+			refs = append(refs, r.ref)
+			delete(this.pending, h)
+		}
+	}
+	this.mu.Unlock()
+
+	for _, ref := range refs {
+		this.store.Delete(ref)
+	}
+}
@@ -2,6 +2,7 @@ package cmq_go
 
 import (
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha1"
 	"encoding/base64"
@@ -21,6 +22,15 @@ const (
 	CURRENT_VERSION = "SDK_GO_1.3"
 )
 
+// HTTPError 服务端返回了非200的HTTP状态码
+type HTTPError struct {
+	StatusCode int
+}
+
+func (this *HTTPError) Error() string {
+	return fmt.Sprintf("http error code %d", this.StatusCode)
+}
+
 type CMQClient struct {
 	uri       *url.URL
 	SecretId  string
@@ -53,8 +63,12 @@ func NewCMQClient(endpoint, path, secretId, secretKey string) *CMQClient {
 }
 
 func (this *CMQClient) callWithoutResult(action string, param map[string]string) error {
+	return this.callWithoutResultContext(context.Background(), action, param)
+}
+
+func (this *CMQClient) callWithoutResultContext(ctx context.Context, action string, param map[string]string) error {
 	res := &CommResp{}
-	if err := this.call(action, param, res); err != nil {
+	if err := this.callContext(ctx, action, param, res); err != nil {
 		return err
 	}
 	if res.Code != 0 {
@@ -64,6 +78,10 @@ func (this *CMQClient) callWithoutResult(action string, param map[string]string)
 }
 
 func (this *CMQClient) call(action string, param map[string]string, ires interface{}) error {
+	return this.callContext(context.Background(), action, param, ires)
+}
+
+func (this *CMQClient) callContext(ctx context.Context, action string, param map[string]string, ires interface{}) error {
 	uriParams := make(url.Values)
 	for k, v := range param {
 		uriParams.Set(k, v)
@@ -91,19 +109,22 @@ func (this *CMQClient) call(action string, param map[string]string, ires interfa
 		userTimeout, _ = strconv.Atoi(UserpollingWaitSeconds)
 	}
 
-	this.conn.Timeout = time.Duration(3000+userTimeout) * time.Millisecond
+	// 超时通过context设置，避免并发请求修改共享的http.Client
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(3000+userTimeout)*time.Millisecond)
+	defer cancel()
 
 	req, err := http.NewRequest(http.MethodPost, this.uri.String(), bytes.NewReader([]byte(paramStr)))
 	if err != nil {
 		return err
 	}
+	req = req.WithContext(ctx)
 	resp, err := this.conn.Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("http error code %d", resp.StatusCode)
+		return &HTTPError{StatusCode: resp.StatusCode}
 	}
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
@@ -0,0 +1,156 @@
+package cmq_go
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+)
+
+// HeaderContentEncoding 记录消息体使用的压缩算法，压缩后的消息体经过base64(URL安全，无填充)编码
+const HeaderContentEncoding = "content-encoding"
+
+// DefaultCompressThreshold 消息体超过该长度才尝试压缩
+const DefaultCompressThreshold = 1024
+
+// Compressor 消息体压缩算法，Name 会写入消息头供接收方查找对应的解压算法
+type Compressor interface {
+	Name() string
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = map[string]Compressor{}
+)
+
+// RegisterCompressor 注册解压时可用的压缩算法，gzip 默认已注册，zstd 等可由使用方注册
+func RegisterCompressor(c Compressor) {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	compressors[c.Name()] = c
+}
+
+func getCompressor(name string) Compressor {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+	return compressors[name]
+}
+
+func init() {
+	RegisterCompressor(GzipCompressor{Level: gzip.DefaultCompression})
+}
+
+type GzipCompressor struct {
+	Level int
+}
+
+func (GzipCompressor) Name() string {
+	return "gzip"
+}
+
+func (this GzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, this.Level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(data); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GzipCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// CompressionStats 压缩统计，Ratio 为压缩后与压缩前的字节数之比
+type CompressionStats struct {
+	/** 被压缩的消息数 */
+	Compressed int64
+	/** 超过阈值但压缩后未变小而原样发送的消息数 */
+	Skipped int64
+	/** 被压缩消息的原始字节数 */
+	RawBytes int64
+	/** 被压缩消息编码后的字节数 */
+	EncodedBytes int64
+}
+
+func (this CompressionStats) Ratio() float64 {
+	if this.RawBytes == 0 {
+		return 1
+	}
+	return float64(this.EncodedBytes) / float64(this.RawBytes)
+}
+
+type compression struct {
+	compressor Compressor
+	threshold  int
+
+	compressed   int64
+	skipped      int64
+	rawBytes     int64
+	encodedBytes int64
+}
+
+func (this *compression) stats() CompressionStats {
+	return CompressionStats{
+		Compressed:   atomic.LoadInt64(&this.compressed),
+		Skipped:      atomic.LoadInt64(&this.skipped),
+		RawBytes:     atomic.LoadInt64(&this.rawBytes),
+		EncodedBytes: atomic.LoadInt64(&this.encodedBytes),
+	}
+}
+
+func (this *compression) compress(msgBody string, headers map[string]string) (string, error) {
+	if len(msgBody) < this.threshold {
+		return msgBody, nil
+	}
+	data, err := this.compressor.Compress([]byte(msgBody))
+	if err != nil {
+		return "", fmt.Errorf("compress with %s: %v", this.compressor.Name(), err)
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(data)
+	if len(encoded) >= len(msgBody) {
+		atomic.AddInt64(&this.skipped, 1)
+		return msgBody, nil
+	}
+	atomic.AddInt64(&this.compressed, 1)
+	atomic.AddInt64(&this.rawBytes, int64(len(msgBody)))
+	atomic.AddInt64(&this.encodedBytes, int64(len(encoded)))
+	headers[HeaderContentEncoding] = this.compressor.Name()
+	return encoded, nil
+}
+
+func decompress(msgBody string, headers map[string]string) (string, error) {
+	name, found := headers[HeaderContentEncoding]
+	if !found {
+		return msgBody, nil
+	}
+	c := getCompressor(name)
+	if c == nil {
+		return msgBody, fmt.Errorf("unknown content-encoding %q", name)
+	}
+	data, err := base64.RawURLEncoding.DecodeString(msgBody)
+	if err != nil {
+		return msgBody, fmt.Errorf("decode %s body: %v", name, err)
+	}
+	if data, err = c.Decompress(data); err != nil {
+		return msgBody, fmt.Errorf("decompress with %s: %v", name, err)
+	}
+	delete(headers, HeaderContentEncoding)
+	return string(data), nil
+}
@@ -0,0 +1,447 @@
+package cmq_go
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Handler 处理一条消息，返回nil时消息被删除，返回错误时消息保留，在可见性超时后重新投递
+type Handler func(ctx context.Context, msg Message) error
+
+// Consumer 从队列批量接收消息并发处理，处理成功后自动删除消息
+type Consumer struct {
+	queue       *Queue
+	handler     Handler
+	middlewares []Middleware
+	chain       Handler
+
+	/** 同时处理的消息数，默认1 */
+	Concurrency int
+	/** 每次 BatchReceiveMessage 最多接收的消息数，默认16 */
+	BatchSize int
+	/** 长轮询等待时间(秒)，默认10，小于0时使用队列的设置 */
+	PollingWaitSeconds int
+	/** 接收失败或不使用长轮询且队列为空时，下次接收前的等待时间，默认1秒 */
+	ErrorBackoff time.Duration
+	/** 接收、解码、处理或删除失败时的回调，接收失败时msg为nil */
+	OnError func(msg *Message, err error)
+	/** 设置后处理成功的消息通过 Acker 批量删除，由 Run 负责运行和最终刷新 */
+	Acker *Acker
+	/** 处理函数的deadline比消息重新可见的时间提前的时长，默认1秒 */
+	DeadlineMargin time.Duration
+	/** 消息最多投递次数，达到后处理仍失败或超过后再次收到的消息转入 DeadLetter，<=0时不限制 */
+	MaxDeliveries int
+	/** 死信的存放位置，MaxDeliveries>0 时需要设置 */
+	DeadLetter DeadLetterSink
+	/** 设置后处理失败的消息按指数延时重新入队，不等待可见性超时 */
+	Retry *RetryPolicy
+	/** 设置后分区键相同的消息按接收顺序依次处理，不同分区键的消息并发处理，返回空字符串的消息不限制顺序；处理失败的消息会在可见性超时或 Retry 的延时之后重新投递，同一分区键之后的消息不等待它，因此失败后分区内不再保证顺序 */
+	PartitionKey func(msg Message) string
+	/** 设置后解码失败的消息直接写入隔离文件并删除，不再重新投递 */
+	Quarantine *Quarantine
+	/** 设置后根据负载自动调整并发轮询数和每批接收的消息数，BatchSize 作为初始批量 */
+	Adaptive *Adaptive
+	/** 除处理中的消息外最多预取的消息数，默认0不预取；Run 停止时缓冲中的消息不删除，等待可见性超时后重新投递 */
+	Prefetch int
+
+	handled      int64
+	failed       int64
+	overruns     int64
+	leaseLost    int64
+	deadLettered int64
+	retried      int64
+	expired      int64
+	released     int64
+	quarantined  int64
+
+	partitions partitions
+	adaptive   atomic.Pointer[adaptive]
+	prefetch   atomic.Pointer[prefetch]
+}
+
+// ConsumerStats 消费统计
+type ConsumerStats struct {
+	/** 处理成功的消息数 */
+	Handled int64
+	/** 解码或处理失败的消息数 */
+	Failed int64
+	/** 处理时间超过deadline的消息数 */
+	Overruns int64
+	/** 处理完成时已超过可见性超时、没有删除的消息数 */
+	LeaseLost int64
+	/** 转入死信的消息数 */
+	DeadLettered int64
+	/** 重新入队的消息数 */
+	Retried int64
+	/** 解码失败写入隔离文件的消息数 */
+	Quarantined int64
+	/** 预取后预计无法在 NextVisibleTime 之前处理完而丢弃的消息数 */
+	Expired int64
+	/** Run 停止时缓冲中没有处理的消息数 */
+	Released int64
+	/** 当前缓冲中等待处理的消息数 */
+	Buffered int
+	/** 当前的并发轮询数，未设置 Adaptive 时为0 */
+	Pollers int
+	/** 当前每批接收的消息数，未设置 Adaptive 时为0 */
+	BatchSize int
+	/** 最近一次采样的 ActiveMsgNum */
+	Backlog int
+	/** 最近一个调整间隔内处理函数的平均耗时 */
+	HandlerLatency time.Duration
+}
+
+func NewConsumer(queue *Queue, handler Handler) *Consumer {
+	return &Consumer{
+		queue:              queue,
+		handler:            handler,
+		chain:              handler,
+		Concurrency:        1,
+		BatchSize:          16,
+		PollingWaitSeconds: 10,
+		ErrorBackoff:       time.Second,
+		DeadlineMargin:     time.Second,
+	}
+}
+
+func (this *Consumer) Stats() ConsumerStats {
+	stats := ConsumerStats{
+		Handled:      atomic.LoadInt64(&this.handled),
+		Failed:       atomic.LoadInt64(&this.failed),
+		Overruns:     atomic.LoadInt64(&this.overruns),
+		LeaseLost:    atomic.LoadInt64(&this.leaseLost),
+		DeadLettered: atomic.LoadInt64(&this.deadLettered),
+		Retried:      atomic.LoadInt64(&this.retried),
+		Expired:      atomic.LoadInt64(&this.expired),
+		Released:     atomic.LoadInt64(&this.released),
+		Quarantined:  atomic.LoadInt64(&this.quarantined),
+	}
+	if p := this.prefetch.Load(); p != nil {
+		stats.Buffered = int(atomic.LoadInt64(&p.buffered))
+	}
+	if a := this.adaptive.Load(); a != nil {
+		stats.Pollers = int(atomic.LoadInt64(&a.pollers))
+		stats.BatchSize = int(atomic.LoadInt64(&a.batchSize))
+		stats.Backlog = int(atomic.LoadInt64(&a.backlog))
+		stats.HandlerLatency = time.Duration(atomic.LoadInt64(&a.latency))
+	}
+	return stats
+}
+
+// Use 为处理函数增加中间件，先增加的在外层，需要在 Run 之前调用
+func (this *Consumer) Use(middlewares ...Middleware) {
+	this.middlewares = append(this.middlewares, middlewares...)
+	this.chain = Chain(this.handler, this.middlewares...)
+}
+
+// Run 循环接收并处理消息，ctx取消后停止接收，等待处理中的消息完成后返回ctx.Err()。
+// 处理中的消息使用不随ctx取消的context，以免处理到一半被中断
+func (this *Consumer) Run(ctx context.Context) error {
+	concurrency := this.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	batchSize := this.BatchSize
+	if batchSize <= 0 || batchSize > 16 {
+		batchSize = 16
+	}
+
+	prefetch := this.Prefetch
+	if prefetch < 0 {
+		prefetch = 0
+	}
+
+	slots := make(chan struct{}, concurrency+prefetch)
+	if prefetch > 0 {
+		this.prefetch.Store(newPrefetch(ctx, concurrency))
+	} else {
+		this.prefetch.Store(nil)
+	}
+	handlerCtx := context.WithoutCancel(ctx)
+	var wg sync.WaitGroup
+	// 处理中的消息全部完成后再停止 Acker，保证最后一批句柄被删除
+	defer this.startAcker(handlerCtx)()
+	defer wg.Wait()
+
+	if this.Adaptive == nil {
+		for ctx.Err() == nil {
+			this.poll(ctx, handlerCtx, slots, &wg, batchSize)
+		}
+		return ctx.Err()
+	}
+
+	// 启动 MaxPollers 个轮询，编号不小于当前轮询数的暂停；所有轮询退出后才等待处理中的消息
+	a := newAdaptive(*this.Adaptive, concurrency, batchSize)
+	this.adaptive.Store(a)
+	var pollers sync.WaitGroup
+	pollers.Add(1)
+	go func() {
+		defer pollers.Done()
+		a.run(ctx, this, concurrency)
+	}()
+	for i := 0; i < a.MaxPollers; i++ {
+		pollers.Add(1)
+		go func(id int64) {
+			defer pollers.Done()
+			for ctx.Err() == nil {
+				if id >= atomic.LoadInt64(&a.pollers) {
+					sleepContext(ctx, a.Interval)
+					continue
+				}
+				this.poll(ctx, handlerCtx, slots, &wg, int(atomic.LoadInt64(&a.batchSize)))
+			}
+		}(int64(i))
+	}
+	pollers.Wait()
+	return ctx.Err()
+}
+
+// poll 接收一批消息并交给处理函数，最多接收batchSize条且不超过空闲的处理位置
+func (this *Consumer) poll(ctx, handlerCtx context.Context, slots chan struct{}, wg *sync.WaitGroup, batchSize int) {
+	n := acquireSlots(ctx, slots, batchSize)
+	if n == 0 {
+		return
+	}
+	p := this.prefetch.Load()
+	if p != nil {
+		if limit := p.limit(n, len(slots)-n, this.DeadlineMargin); limit < n {
+			releaseSlots(slots, n-max(limit, 0))
+			if n = limit; n <= 0 {
+				// 缓冲已满足可见性超时内能处理的数量，等待处理函数
+				sleepContext(ctx, time.Duration(atomic.LoadInt64(&p.latency)))
+				return
+			}
+		}
+	}
+	received := time.Now()
+	msgs, err := this.queue.batchReceiveMessage(ctx, n, this.PollingWaitSeconds)
+	releaseSlots(slots, n-len(msgs))
+	if p != nil {
+		p.observeReceive(msgs, received)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		if !isNoMessage(err) {
+			this.report(nil, err)
+			sleepContext(ctx, this.ErrorBackoff)
+			return
+		}
+		if a := this.adaptive.Load(); a != nil {
+			a.observePoll(0, n)
+		}
+		if this.PollingWaitSeconds == 0 {
+			sleepContext(ctx, this.ErrorBackoff)
+		}
+		return
+	}
+	if a := this.adaptive.Load(); a != nil {
+		a.observePoll(len(msgs), n)
+	}
+	this.dispatch(handlerCtx, msgs, wg, slots)
+}
+
+// dispatch 每条消息启动一个goroutine处理，处理完成后释放占用的位置
+func (this *Consumer) dispatch(ctx context.Context, msgs []Message, wg *sync.WaitGroup, slots chan struct{}) {
+	for i := range msgs {
+		if this.PartitionKey != nil {
+			this.dispatchOrdered(ctx, msgs[i], wg, slots)
+			continue
+		}
+		wg.Add(1)
+		go func(msg Message) {
+			defer wg.Done()
+			defer releaseSlots(slots, 1)
+			if this.prepare(&msg) {
+				this.handle(ctx, msg)
+			}
+		}(msgs[i])
+	}
+}
+
+// startAcker 在后台运行 Acker，返回停止并等待最后一批删除完成的函数；未设置 Acker 时什么也不做
+func (this *Consumer) startAcker(ctx context.Context) func() {
+	if this.Acker == nil {
+		return func() {}
+	}
+	ackCtx, stopAck := context.WithCancel(ctx)
+	ackDone := make(chan struct{})
+	go func() {
+		this.Acker.Run(ackCtx)
+		close(ackDone)
+	}()
+	return func() {
+		stopAck()
+		<-ackDone
+	}
+}
+
+// prepare 解码消息，返回false表示消息不需要交给处理函数
+func (this *Consumer) prepare(msg *Message) bool {
+	deliver, err := this.queue.prepare(msg)
+	if !deliver {
+		return false
+	}
+	if err != nil {
+		this.fail(*msg, err, false)
+		return false
+	}
+	return true
+}
+
+func (this *Consumer) handle(ctx context.Context, msg Message) {
+	p := this.prefetch.Load()
+	if p != nil {
+		ok, expired := p.acquire(msg, this.DeadlineMargin)
+		if !ok {
+			if expired {
+				atomic.AddInt64(&this.expired, 1)
+			} else {
+				atomic.AddInt64(&this.released, 1)
+			}
+			return
+		}
+		defer p.release()
+	}
+
+	if this.exhausted(msg, 1) {
+		if this.deadLetter(this.DeadLetter, msg, "max deliveries exceeded", false) {
+			atomic.AddInt64(&this.deadLettered, 1)
+		}
+		return
+	}
+
+	// 处理函数需要在消息重新可见之前完成，否则消息会被重复消费
+	hctx, cancel := leaseContext(ctx, msg, this.DeadlineMargin)
+	start := time.Now()
+	err := this.chain(hctx, msg)
+	if a := this.adaptive.Load(); a != nil {
+		a.observeHandle(time.Since(start))
+	}
+	if p != nil {
+		p.observeHandle(time.Since(start))
+	}
+	if hctx.Err() == context.DeadlineExceeded {
+		atomic.AddInt64(&this.overruns, 1)
+	}
+	cancel()
+	if err != nil {
+		this.fail(msg, err, true)
+		return
+	}
+	if err = leaseLost(msg); err != nil {
+		atomic.AddInt64(&this.leaseLost, 1)
+		this.report(&msg, err)
+		return
+	}
+	atomic.AddInt64(&this.handled, 1)
+	this.ack(msg)
+}
+
+// fail 处理失败，已达到最多投递次数时转入死信；配置了 Retry 时延时重新入队，否则等待可见性超时后重新投递。
+// 解码失败(decoded为false)的消息无法重新编码，不会重新入队，配置了 Quarantine 时直接隔离
+func (this *Consumer) fail(msg Message, err error, decoded bool) {
+	atomic.AddInt64(&this.failed, 1)
+	this.report(&msg, err)
+	if !decoded && this.Quarantine != nil {
+		if this.deadLetter(this.Quarantine, msg, err.Error(), true) {
+			atomic.AddInt64(&this.quarantined, 1)
+		}
+		return
+	}
+	if this.exhausted(msg, 0) {
+		if this.deadLetter(this.DeadLetter, msg, err.Error(), !decoded) {
+			atomic.AddInt64(&this.deadLettered, 1)
+		}
+		return
+	}
+	if !decoded || this.Retry == nil || (this.Retry.MaxAttempts > 0 && attempts(msg) >= this.Retry.MaxAttempts) {
+		return
+	}
+	if err = this.requeue(msg); err != nil {
+		this.report(&msg, err)
+		return
+	}
+	atomic.AddInt64(&this.retried, 1)
+	this.ack(msg)
+}
+
+// exhausted 累计投递次数达到 MaxDeliveries+extra
+func (this *Consumer) exhausted(msg Message, extra int) bool {
+	return this.MaxDeliveries > 0 && this.DeadLetter != nil && deliveries(msg) >= this.MaxDeliveries+extra
+}
+
+// deadLetter 把消息交给sink并删除，raw表示消息解码失败；sink出错时返回false，消息等待重新投递
+func (this *Consumer) deadLetter(sink DeadLetterSink, msg Message, reason string, raw bool) bool {
+	info := DeadLetterInfo{
+		QueueName:    this.queue.queueName,
+		MsgId:        msg.MsgId,
+		DequeueCount: deliveries(msg),
+		LastError:    reason,
+		Time:         time.Now(),
+		Raw:          raw,
+	}
+	if err := sink.DeadLetter(msg, info); err != nil {
+		this.report(&msg, err)
+		return false
+	}
+	// 原始消息或隔离的消息可能仍引用 claim check 的数据，删除消息时保留
+	if _, quarantined := sink.(*Quarantine); raw || quarantined {
+		this.queue.codec.forget(msg.ReceiptHandle)
+	}
+	this.ack(msg)
+	return true
+}
+
+func (this *Consumer) ack(msg Message) {
+	if this.Acker != nil {
+		this.Acker.Ack(msg)
+		return
+	}
+	if err := this.queue.DeleteMessage(msg.ReceiptHandle); err != nil {
+		this.report(&msg, err)
+	}
+}
+
+func (this *Consumer) report(msg *Message, err error) {
+	if this.OnError != nil {
+		this.OnError(msg, err)
+	}
+}
+
+// acquireSlots 阻塞直到获得至少一个空闲位置，再尽量多获取，最多max个；ctx取消时返回0
+func acquireSlots(ctx context.Context, slots chan struct{}, max int) int {
+	select {
+	case <-ctx.Done():
+		return 0
+	case slots <- struct{}{}:
+	}
+	n := 1
+	for n < max {
+		select {
+		case slots <- struct{}{}:
+			n++
+		default:
+			return n
+		}
+	}
+	return n
+}
+
+func releaseSlots(slots chan struct{}, n int) {
+	for i := 0; i < n; i++ {
+		<-slots
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
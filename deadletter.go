@@ -0,0 +1,112 @@
+package cmq_go
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 死信消息携带的失败信息
+const (
+	HeaderDeadLetterReason = "dead-letter-reason"
+	HeaderDeadLetterSource = "dead-letter-source"
+	HeaderOriginalMsgId    = "original-msg-id"
+	HeaderDequeueCount     = "dequeue-count"
+)
+
+// DeadLetterInfo 消息被转入死信的原因
+type DeadLetterInfo struct {
+	/** 来源队列 */
+	QueueName string `json:"queueName"`
+	/** 原始消息ID */
+	MsgId string `json:"msgId"`
+	/** 出队列次数 */
+	DequeueCount int `json:"dequeueCount"`
+	/** 最后一次失败的原因 */
+	LastError string `json:"lastError"`
+	/** 转入死信的时间 */
+	Time time.Time `json:"time"`
+	/** 消息解码失败，MsgBody 是收到的原始内容 */
+	Raw bool `json:"raw,omitempty"`
+}
+
+// DeadLetterSink 死信的存放位置，返回nil后原消息会从来源队列删除
+type DeadLetterSink interface {
+	DeadLetter(msg Message, info DeadLetterInfo) error
+}
+
+func deadLetterHeaders(msg Message, info DeadLetterInfo) map[string]string {
+	headers := make(map[string]string, len(msg.Headers)+4)
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[HeaderDeadLetterReason] = info.LastError
+	headers[HeaderDeadLetterSource] = info.QueueName
+	headers[HeaderOriginalMsgId] = info.MsgId
+	headers[HeaderDequeueCount] = strconv.Itoa(info.DequeueCount)
+	return headers
+}
+
+// QueueDeadLetter 把死信发送到另一个队列，失败信息记录在信封消息头中
+type QueueDeadLetter struct {
+	queue *Queue
+}
+
+func NewQueueDeadLetter(queue *Queue) *QueueDeadLetter {
+	return &QueueDeadLetter{queue: queue}
+}
+
+func (this *QueueDeadLetter) DeadLetter(msg Message, info DeadLetterInfo) error {
+	_, err := this.queue.SendMessageWithHeaders(msg.MsgBody, deadLetterHeaders(msg, info))
+	return err
+}
+
+// TopicDeadLetter 把死信发布到主题，失败信息记录在信封消息头中
+type TopicDeadLetter struct {
+	topic *Topic
+}
+
+func NewTopicDeadLetter(topic *Topic) *TopicDeadLetter {
+	return &TopicDeadLetter{topic: topic}
+}
+
+func (this *TopicDeadLetter) DeadLetter(msg Message, info DeadLetterInfo) error {
+	_, err := this.topic.PublishMessageWithHeaders(msg.MsgBody, nil, deadLetterHeaders(msg, info))
+	return err
+}
+
+// FileDeadLetter 把死信以JSON行的格式追加到本地文件
+type FileDeadLetter struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func NewFileDeadLetter(path string) (*FileDeadLetter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileDeadLetter{f: f}, nil
+}
+
+func (this *FileDeadLetter) DeadLetter(msg Message, info DeadLetterInfo) error {
+	line, err := json.Marshal(struct {
+		Message        Message        `json:"message"`
+		DeadLetterInfo DeadLetterInfo `json:"deadLetter"`
+	}{msg, info})
+	if err != nil {
+		return err
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if _, err = this.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return this.f.Sync()
+}
+
+func (this *FileDeadLetter) Close() error {
+	return this.f.Close()
+}
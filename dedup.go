@@ -0,0 +1,176 @@
+package cmq_go
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// HeaderDedupKey 去重键，随信封发送，消费方也可据此去重
+const HeaderDedupKey = "dedup-key"
+
+// DefaultDedupWindow 生产端默认的去重窗口
+const DefaultDedupWindow = 10 * time.Minute
+
+// DedupStore 带过期时间的键值存储，用于记录已发送的去重键
+type DedupStore interface {
+	Get(key string) (value string, found bool, err error)
+	Set(key, value string, ttl time.Duration) error
+}
+
+// AtomicDedupStore 支持原子预占的 DedupStore。生产端去重使用它在发送前预占去重键，
+// 并发发送或超时后重试的相同去重键只发送一次
+type AtomicDedupStore interface {
+	DedupStore
+	// SetIfAbsent 键不存在(或已过期)时写入并返回stored为true，否则返回已有的值
+	SetIfAbsent(key, value string, ttl time.Duration) (existing string, stored bool, err error)
+	Delete(key string) error
+}
+
+// MemoryDedupStore 内存中的 AtomicDedupStore，超过容量时淘汰最久未使用的键
+type MemoryDedupStore struct {
+	capacity int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type dedupEntry struct {
+	key     string
+	value   string
+	expires time.Time
+}
+
+func NewMemoryDedupStore(capacity int) *MemoryDedupStore {
+	return &MemoryDedupStore{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+func (this *MemoryDedupStore) Get(key string) (string, bool, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.get(key)
+}
+
+func (this *MemoryDedupStore) get(key string) (string, bool, error) {
+	elem, found := this.entries[key]
+	if !found {
+		return "", false, nil
+	}
+	entry := elem.Value.(*dedupEntry)
+	if time.Now().After(entry.expires) {
+		this.lru.Remove(elem)
+		delete(this.entries, key)
+		return "", false, nil
+	}
+	this.lru.MoveToFront(elem)
+	return entry.value, true, nil
+}
+
+func (this *MemoryDedupStore) Set(key, value string, ttl time.Duration) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.set(key, value, ttl)
+}
+
+func (this *MemoryDedupStore) SetIfAbsent(key, value string, ttl time.Duration) (string, bool, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if existing, found, _ := this.get(key); found {
+		return existing, false, nil
+	}
+	return "", true, this.set(key, value, ttl)
+}
+
+func (this *MemoryDedupStore) Delete(key string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if elem, found := this.entries[key]; found {
+		this.lru.Remove(elem)
+		delete(this.entries, key)
+	}
+	return nil
+}
+
+func (this *MemoryDedupStore) set(key, value string, ttl time.Duration) error {
+	expires := time.Now().Add(ttl)
+	if elem, found := this.entries[key]; found {
+		elem.Value = &dedupEntry{key: key, value: value, expires: expires}
+		this.lru.MoveToFront(elem)
+		return nil
+	}
+	this.entries[key] = this.lru.PushFront(&dedupEntry{key: key, value: value, expires: expires})
+	for this.capacity > 0 && this.lru.Len() > this.capacity {
+		oldest := this.lru.Back()
+		this.lru.Remove(oldest)
+		delete(this.entries, oldest.Value.(*dedupEntry).key)
+	}
+	return nil
+}
+
+// dedup 生产端去重窗口，窗口内相同去重键的消息只发送一次，重复发送返回第一次的msgId。
+// store 实现 AtomicDedupStore 时发送前预占去重键，否则只在发送成功后记录，并发或结果未知后重试的消息仍会重复发送。
+// 存储出错时不做去重，仍然发送
+type dedup struct {
+	store  DedupStore
+	window time.Duration
+}
+
+func newDedup(store DedupStore, window time.Duration) *dedup {
+	if store == nil {
+		return nil
+	}
+	if window <= 0 {
+		window = DefaultDedupWindow
+	}
+	return &dedup{store: store, window: window}
+}
+
+// reserve 在发送前检查去重键，dup为true时不发送，直接返回msgId；reserved表示已原子地预占去重键
+func (this *dedup) reserve(namespace, key string) (msgId string, dup, reserved bool) {
+	if this == nil || key == "" {
+		return "", false, false
+	}
+	if store, ok := this.store.(AtomicDedupStore); ok {
+		existing, stored, err := store.SetIfAbsent(namespace+"/"+key, "", this.window)
+		if err != nil {
+			return "", false, false
+		}
+		return existing, !stored, stored
+	}
+	msgId, found, err := this.store.Get(namespace + "/" + key)
+	return msgId, found && err == nil, false
+}
+
+// finish 在发送后记录服务端返回的msgId。写入暂存区的消息没有msgId，暂存区转发失败时消息可能不会送达，
+// 因此与确定失败的发送一样释放预占，重复发送时会再次发送，消费方可以按随消息发送的去重键去重；
+// 结果未知(超时等)的发送保留预占，窗口内的重试不再发送
+func (this *dedup) finish(namespace, key, msgId string, err error, reserved bool) {
+	if this == nil || key == "" {
+		return
+	}
+	switch {
+	case err == nil && msgId != "":
+		this.store.Set(namespace+"/"+key, msgId, this.window)
+	case reserved && (err == nil || !uncertain(err)):
+		this.store.(AtomicDedupStore).Delete(namespace + "/" + key)
+	}
+}
+
+// uncertain 判断发送失败时消息是否可能已被服务端接收
+func uncertain(err error) bool {
+	switch e := err.(type) {
+	case *HTTPError:
+		return e.StatusCode >= 500
+	case net.Error:
+		return true
+	}
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,170 @@
+package cmq_go
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"sync"
+)
+
+// 加密后的消息体为 base64(URL安全，无填充)(nonce + 密文)，使用的密钥ID记录在消息头中
+const (
+	HeaderEncryption      = "encryption"
+	HeaderEncryptionKeyID = "encryption-key-id"
+
+	encryptionAESGCM = "aes-gcm"
+)
+
+// KeyProvider 提供AES密钥(16/24/32字节)，CurrentKey 用于加密，Key 按ID查找解密用的密钥
+type KeyProvider interface {
+	CurrentKey() (keyId string, key []byte, err error)
+	Key(keyId string) ([]byte, error)
+}
+
+// KeyRing 内存中的KeyProvider，轮换密钥时先 AddKey 再 SetCurrent，旧密钥在存量消息消费完之前保留
+type KeyRing struct {
+	mu      sync.RWMutex
+	current string
+	keys    map[string][]byte
+}
+
+func NewKeyRing(currentKeyId string, keys map[string][]byte) (*KeyRing, error) {
+	ring := &KeyRing{keys: make(map[string][]byte)}
+	for id, key := range keys {
+		if err := ring.AddKey(id, key); err != nil {
+			return nil, err
+		}
+	}
+	if err := ring.SetCurrent(currentKeyId); err != nil {
+		return nil, err
+	}
+	return ring, nil
+}
+
+func (this *KeyRing) AddKey(keyId string, key []byte) error {
+	if keyId == "" {
+		return fmt.Errorf("key id is empty")
+	}
+	switch len(key) {
+	case 16, 24, 32:
+	default:
+		return fmt.Errorf("key %s: invalid AES key size %d", keyId, len(key))
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.keys[keyId] = append([]byte(nil), key...)
+	return nil
+}
+
+func (this *KeyRing) RemoveKey(keyId string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if keyId != this.current {
+		delete(this.keys, keyId)
+	}
+}
+
+func (this *KeyRing) SetCurrent(keyId string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if _, found := this.keys[keyId]; !found {
+		return fmt.Errorf("key %s not found", keyId)
+	}
+	this.current = keyId
+	return nil
+}
+
+func (this *KeyRing) CurrentKey() (string, []byte, error) {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	if this.current == "" {
+		return "", nil, fmt.Errorf("no current key")
+	}
+	return this.current, this.keys[this.current], nil
+}
+
+func (this *KeyRing) Key(keyId string) ([]byte, error) {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	key, found := this.keys[keyId]
+	if !found {
+		return nil, fmt.Errorf("key %s not found", keyId)
+	}
+	return key, nil
+}
+
+// DecryptError 消息无法解密（没有配置KeyProvider、密钥不存在或数据被篡改），消息体保持密文
+type DecryptError struct {
+	MsgId string
+	KeyId string
+	Err   error
+}
+
+func (this *DecryptError) Error() string {
+	return fmt.Sprintf("message %s: decrypt with key %q: %v", this.MsgId, this.KeyId, this.Err)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encrypt(keys KeyProvider, msgBody string, headers map[string]string) (string, error) {
+	keyId, key, err := keys.CurrentKey()
+	if err != nil {
+		return "", fmt.Errorf("encrypt: %v", err)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", fmt.Errorf("encrypt with key %s: %v", keyId, err)
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("encrypt: %v", err)
+	}
+	// 密钥ID作为附加数据，防止消息头被替换
+	sealed := gcm.Seal(nonce, nonce, []byte(msgBody), []byte(keyId))
+	headers[HeaderEncryption] = encryptionAESGCM
+	headers[HeaderEncryptionKeyID] = keyId
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func decrypt(keys KeyProvider, msg *Message, msgBody string, headers map[string]string) (string, error) {
+	keyId := headers[HeaderEncryptionKeyID]
+	fail := func(err error) (string, error) {
+		return msgBody, &DecryptError{MsgId: msg.MsgId, KeyId: keyId, Err: err}
+	}
+	if alg := headers[HeaderEncryption]; alg != encryptionAESGCM {
+		return fail(fmt.Errorf("unsupported encryption %q", alg))
+	}
+	if keys == nil {
+		return fail(fmt.Errorf("no KeyProvider configured"))
+	}
+	key, err := keys.Key(keyId)
+	if err != nil {
+		return fail(err)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return fail(err)
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(msgBody)
+	if err != nil {
+		return fail(err)
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return fail(fmt.Errorf("ciphertext too short"))
+	}
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(keyId))
+	if err != nil {
+		return fail(err)
+	}
+	delete(headers, HeaderEncryption)
+	delete(headers, HeaderEncryptionKeyID)
+	return string(plain), nil
+}
@@ -0,0 +1,181 @@
+package cmq_go
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// 信封格式：envelopePrefix + 版本号 + 空格 + URL编码的消息头 + "\n" + 原始消息体
+// 例如 "~cmq/1 content-type=application%2Fjson&correlation-id=42\n{...}"
+const (
+	envelopePrefix  = "~cmq/"
+	envelopeVersion = 1
+)
+
+// 常用消息头
+const (
+	HeaderContentType   = "content-type"
+	HeaderSchemaVersion = "schema-version"
+	HeaderCorrelationID = "correlation-id"
+	HeaderTraceParent   = "traceparent"
+	HeaderTraceState    = "tracestate"
+	HeaderSource        = "source"
+)
+
+func encodeEnvelope(msgBody string, headers map[string]string) string {
+	values := make(url.Values, len(headers))
+	for k, v := range headers {
+		values.Set(strings.ToLower(k), v)
+	}
+	return envelopePrefix + strconv.Itoa(envelopeVersion) + " " + values.Encode() + "\n" + msgBody
+}
+
+// decodeEnvelope 解析信封，非信封格式（或无法识别的版本）的消息体原样返回，ok为false
+func decodeEnvelope(raw string) (msgBody string, headers map[string]string, ok bool) {
+	if !strings.HasPrefix(raw, envelopePrefix) {
+		return raw, nil, false
+	}
+	rest := raw[len(envelopePrefix):]
+	sp := strings.IndexByte(rest, ' ')
+	nl := strings.IndexByte(rest, '\n')
+	if sp < 0 || nl < sp {
+		return raw, nil, false
+	}
+	if version, err := strconv.Atoi(rest[:sp]); err != nil || version < 1 || version > envelopeVersion {
+		return raw, nil, false
+	}
+	values, err := url.ParseQuery(rest[sp+1 : nl])
+	if err != nil {
+		return raw, nil, false
+	}
+	headers = make(map[string]string, len(values))
+	for k := range values {
+		headers[k] = values.Get(k)
+	}
+	return rest[nl+1:], headers, true
+}
+
+// codec 负责消息体发送前的编码和接收后的解码，Queue和Topic各持有一份
+type codec struct {
+	envelope    bool
+	compression *compression
+	claimCheck  *claimCheck
+	keys        KeyProvider
+	// 主题消息会扇出到多个队列
+	fanout bool
+}
+
+func (this *codec) setCompression(c Compressor, threshold int) {
+	if c == nil {
+		this.compression = nil
+		return
+	}
+	if threshold <= 0 {
+		threshold = DefaultCompressThreshold
+	}
+	this.compression = &compression{compressor: c, threshold: threshold}
+}
+
+func (this *codec) compressionStats() CompressionStats {
+	if this.compression == nil {
+		return CompressionStats{}
+	}
+	return this.compression.stats()
+}
+
+func (this *codec) setClaimCheck(store BlobStore, threshold int) {
+	if store == nil {
+		this.claimCheck = nil
+		return
+	}
+	if threshold <= 0 {
+		threshold = DefaultClaimCheckThreshold
+	}
+	this.claimCheck = &claimCheck{store: store, threshold: threshold, shared: this.fanout}
+}
+
+func (this *codec) forget(receiptHandle string) {
+	if this.claimCheck != nil {
+		this.claimCheck.forget(receiptHandle)
+	}
+}
+
+func (this *codec) release(receiptHandles ...string) {
+	if this.claimCheck != nil {
+		this.claimCheck.release(receiptHandles...)
+	}
+}
+
+func (this *codec) encode(msgBody string, headers map[string]string) (string, error) {
+	h := make(map[string]string, len(headers)+1)
+	for k, v := range headers {
+		h[strings.ToLower(k)] = v
+	}
+	var err error
+	if this.compression != nil {
+		if msgBody, err = this.compression.compress(msgBody, h); err != nil {
+			return "", err
+		}
+	}
+	if this.keys != nil {
+		if msgBody, err = encrypt(this.keys, msgBody, h); err != nil {
+			return "", err
+		}
+	}
+	if this.claimCheck != nil {
+		if msgBody, err = this.claimCheck.put(msgBody, h); err != nil {
+			return "", err
+		}
+	}
+	if !this.envelope && len(h) == 0 {
+		return msgBody, nil
+	}
+	return encodeEnvelope(msgBody, h), nil
+}
+
+func (this *codec) encodeAll(msgBodys []string, headers map[string]string) ([]string, error) {
+	encoded := make([]string, len(msgBodys))
+	for i, msgBody := range msgBodys {
+		body, err := this.encode(msgBody, headers)
+		if err != nil {
+			return nil, fmt.Errorf("encode message %d: %v", i, err)
+		}
+		encoded[i] = body
+	}
+	return encoded, nil
+}
+
+func (this *codec) decode(msg *Message) error {
+	body, headers, ok := decodeEnvelope(msg.MsgBody)
+	if !ok {
+		return nil
+	}
+	var ref string
+	var err error
+	if _, found := headers[HeaderClaimCheck]; found {
+		if this.claimCheck == nil {
+			return fmt.Errorf("message %s: claim check %s but no BlobStore configured", msg.MsgId, headers[HeaderClaimCheck])
+		}
+		if body, ref, err = this.claimCheck.resolve(headers); err != nil {
+			return fmt.Errorf("message %s: %v", msg.MsgId, err)
+		}
+	}
+	if _, found := headers[HeaderEncryption]; found {
+		if body, err = decrypt(this.keys, msg, body, headers); err != nil {
+			return err
+		}
+	}
+	if body, err = decompress(body, headers); err != nil {
+		return fmt.Errorf("message %s: %v", msg.MsgId, err)
+	}
+	// 定时消息的转发对处理函数不可见
+	delete(headers, HeaderDeliverAt)
+	delete(headers, HeaderDeliveryHops)
+	if ref != "" && msg.ReceiptHandle != "" {
+		this.claimCheck.track(msg.ReceiptHandle, ref, visibleAt(*msg))
+	}
+	msg.MsgBody, msg.Headers = body, headers
+	return nil
+}
@@ -0,0 +1,175 @@
+package cmq_go
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// TxDedupStore 支持事务的 DedupStore，去重记录与处理函数的数据库写入在同一事务中提交
+type TxDedupStore interface {
+	DedupStore
+	BeginTx(ctx context.Context) (*sql.Tx, error)
+	GetTx(ctx context.Context, tx *sql.Tx, key string) (value string, found bool, err error)
+	SetTx(ctx context.Context, tx *sql.Tx, key, value string, ttl time.Duration) error
+}
+
+type txKey struct{}
+
+// TxFromContext 返回 Idempotent 为本次处理开启的事务，存储不支持事务时返回nil
+func TxFromContext(ctx context.Context) *sql.Tx {
+	tx, _ := ctx.Value(txKey{}).(*sql.Tx)
+	return tx
+}
+
+// dedupKey 优先使用生产端设置的去重键，否则使用MsgId
+func dedupKey(msg Message) string {
+	if key := msg.Headers[HeaderDedupKey]; key != "" {
+		return "key/" + key
+	}
+	return "msg/" + msg.MsgId
+}
+
+// Idempotent 跳过ttl内已处理成功的消息(直接确认删除)。store 实现 TxDedupStore 时，
+// 处理函数通过 TxFromContext 取得事务，去重记录与业务数据一起提交，处理失败时一起回滚
+func Idempotent(store DedupStore, ttl time.Duration) Middleware {
+	return func(next Handler) Handler {
+		if txStore, ok := store.(TxDedupStore); ok {
+			return func(ctx context.Context, msg Message) error {
+				return idempotentTx(ctx, txStore, ttl, next, msg)
+			}
+		}
+		return func(ctx context.Context, msg Message) error {
+			key := dedupKey(msg)
+			if _, found, err := store.Get(key); err != nil {
+				return err
+			} else if found {
+				return nil
+			}
+			if err := next(ctx, msg); err != nil {
+				return err
+			}
+			return store.Set(key, msg.MsgId, ttl)
+		}
+	}
+}
+
+func idempotentTx(ctx context.Context, store TxDedupStore, ttl time.Duration, next Handler, msg Message) error {
+	tx, err := store.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	key := dedupKey(msg)
+	if _, found, err := store.GetTx(ctx, tx, key); err != nil {
+		return err
+	} else if found {
+		return nil
+	}
+	if err = next(context.WithValue(ctx, txKey{}, tx), msg); err != nil {
+		return err
+	}
+	// 并发处理同一消息时主键冲突，后提交的一方回滚后等待重新投递
+	if err = store.SetTx(ctx, tx, key, msg.MsgId, ttl); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SQLDedupStore 基于数据库表的 TxDedupStore，表结构见 CreateTable
+type SQLDedupStore struct {
+	db    *sql.DB
+	table string
+	/** 参数占位符，默认为 "?"(MySQL/SQLite)，PostgreSQL 需设置为 "$n" 形式 */
+	Placeholder func(n int) string
+}
+
+func NewSQLDedupStore(db *sql.DB, table string) *SQLDedupStore {
+	return &SQLDedupStore{
+		db:          db,
+		table:       table,
+		Placeholder: func(int) string { return "?" },
+	}
+}
+
+// CreateTable 创建去重表(已存在时忽略)，可用于 SQLite、MySQL 和 PostgreSQL
+func (this *SQLDedupStore) CreateTable(ctx context.Context) error {
+	_, err := this.db.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	dedup_key VARCHAR(255) NOT NULL PRIMARY KEY,
+	value VARCHAR(255) NOT NULL,
+	expires_at BIGINT NOT NULL
+)`, this.table))
+	return err
+}
+
+type execQuerier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func (this *SQLDedupStore) get(ctx context.Context, q execQuerier, key string) (string, bool, error) {
+	var value string
+	var expiresAt int64
+	query := fmt.Sprintf("SELECT value, expires_at FROM %s WHERE dedup_key = %s", this.table, this.Placeholder(1))
+	err := q.QueryRowContext(ctx, query, key).Scan(&value, &expiresAt)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	if expiresAt < time.Now().Unix() {
+		return "", false, nil
+	}
+	return value, true, nil
+}
+
+// set 先删除已过期的记录再插入，未过期的记录存在时插入失败
+func (this *SQLDedupStore) set(ctx context.Context, q execQuerier, key, value string, ttl time.Duration) error {
+	now := time.Now()
+	query := fmt.Sprintf("DELETE FROM %s WHERE dedup_key = %s AND expires_at < %s", this.table, this.Placeholder(1), this.Placeholder(2))
+	if _, err := q.ExecContext(ctx, query, key, now.Unix()); err != nil {
+		return err
+	}
+	query = fmt.Sprintf("INSERT INTO %s (dedup_key, value, expires_at) VALUES (%s, %s, %s)",
+		this.table, this.Placeholder(1), this.Placeholder(2), this.Placeholder(3))
+	_, err := q.ExecContext(ctx, query, key, value, now.Add(ttl).Unix())
+	return err
+}
+
+func (this *SQLDedupStore) Get(key string) (string, bool, error) {
+	return this.get(context.Background(), this.db, key)
+}
+
+func (this *SQLDedupStore) Set(key, value string, ttl time.Duration) error {
+	tx, err := this.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err = this.set(context.Background(), tx, key, value, ttl); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (this *SQLDedupStore) BeginTx(ctx context.Context) (*sql.Tx, error) {
+	return this.db.BeginTx(ctx, nil)
+}
+
+func (this *SQLDedupStore) GetTx(ctx context.Context, tx *sql.Tx, key string) (string, bool, error) {
+	return this.get(ctx, tx, key)
+}
+
+func (this *SQLDedupStore) SetTx(ctx context.Context, tx *sql.Tx, key, value string, ttl time.Duration) error {
+	return this.set(ctx, tx, key, value, ttl)
+}
+
+// Purge 删除已过期的记录
+func (this *SQLDedupStore) Purge(ctx context.Context) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE expires_at < %s", this.table, this.Placeholder(1))
+	_, err := this.db.ExecContext(ctx, query, time.Now().Unix())
+	return err
+}
@@ -0,0 +1,85 @@
+package cmq_go
+
+import (
+	"context"
+	"iter"
+)
+
+// 列表接口每页的数量
+const listPageSize = 50
+
+// All 批量接收消息直到ctx取消或长轮询后队列为空，消息需要调用方删除；出错时返回错误后结束
+func (this *Queue) All(ctx context.Context, opts ReceiveOptions) iter.Seq2[Message, error] {
+	if opts.BatchSize <= 0 || opts.BatchSize > 16 {
+		opts.BatchSize = 16
+	}
+	if opts.PollingWaitSeconds == 0 {
+		opts.PollingWaitSeconds = 10
+	}
+	return func(yield func(Message, error) bool) {
+		for ctx.Err() == nil {
+			msgs, err := this.batchReceiveMessage(ctx, opts.BatchSize, opts.PollingWaitSeconds)
+			if isNoMessage(err) {
+				return
+			}
+			if err != nil {
+				if ctx.Err() == nil {
+					yield(Message{}, err)
+				}
+				return
+			}
+			for i := range msgs {
+				deliver, err := this.prepare(&msgs[i])
+				if !deliver {
+					continue
+				}
+				if !yield(msgs[i], err) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// paginate 按offset翻页，直到取完totalCount条或某一页为空
+func paginate(ctx context.Context, list func(offset, limit int) (int, []string, error)) iter.Seq2[string, error] {
+	return func(yield func(string, error) bool) {
+		for offset := 0; ctx.Err() == nil; {
+			totalCount, names, err := list(offset, listPageSize)
+			if err != nil {
+				yield("", err)
+				return
+			}
+			for _, name := range names {
+				if !yield(name, nil) {
+					return
+				}
+			}
+			offset += len(names)
+			if len(names) == 0 || offset >= totalCount {
+				return
+			}
+		}
+	}
+}
+
+// Queues 遍历名字包含searchWord的所有队列
+func (this *Account) Queues(ctx context.Context, searchWord string) iter.Seq2[string, error] {
+	return paginate(ctx, func(offset, limit int) (int, []string, error) {
+		return this.ListQueue(searchWord, offset, limit)
+	})
+}
+
+// Topics 遍历名字包含searchWord的所有主题
+func (this *Account) Topics(ctx context.Context, searchWord string) iter.Seq2[string, error] {
+	return paginate(ctx, func(offset, limit int) (int, []string, error) {
+		return this.ListTopic(searchWord, offset, limit)
+	})
+}
+
+// Subscriptions 遍历主题的所有订阅
+func (this *Topic) Subscriptions(ctx context.Context) iter.Seq2[string, error] {
+	return paginate(ctx, func(offset, limit int) (int, []string, error) {
+		return this.ListSubscription(offset, limit, "")
+	})
+}
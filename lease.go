@@ -0,0 +1,47 @@
+package cmq_go
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// LeaseLostError 消息处理完成时已超过 NextVisibleTime，消息可能已被重新投递，不再删除
+type LeaseLostError struct {
+	MsgId string
+	/** 超过 NextVisibleTime 的时长 */
+	Overrun time.Duration
+}
+
+func (this *LeaseLostError) Error() string {
+	return fmt.Sprintf("message %s: lease lost, handler finished %v after visibility timeout", this.MsgId, this.Overrun)
+}
+
+// visibleAt 消息重新可见的时间，NextVisibleTime 未知时返回零值
+func visibleAt(msg Message) time.Time {
+	if msg.NextVisibleTime <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, msg.NextVisibleTime*int64(time.Millisecond))
+}
+
+// leaseContext 为处理函数设置在消息重新可见前margin到期的deadline
+func leaseContext(ctx context.Context, msg Message, margin time.Duration) (context.Context, context.CancelFunc) {
+	at := visibleAt(msg)
+	if at.IsZero() {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, at.Add(-margin))
+}
+
+// leaseLost 消息已经超过 NextVisibleTime 时返回 LeaseLostError
+func leaseLost(msg Message) error {
+	at := visibleAt(msg)
+	if at.IsZero() {
+		return nil
+	}
+	if overrun := time.Since(at); overrun > 0 {
+		return &LeaseLostError{MsgId: msg.MsgId, Overrun: overrun}
+	}
+	return nil
+}
@@ -1,6 +1,9 @@
 package cmq_go
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 type Message struct {
 	/** 服务器返回的消息ID */
@@ -18,8 +21,13 @@ type Message struct {
 	/** 出队列次数 */
 	DequeueCount int `json:"dequeueCount"`
 	MsgTag       []string
+	/** 信封中携带的消息头，消息体不是信封格式时为nil */
+	Headers map[string]string `json:"headers,omitempty"`
 }
 
+// 队列中没有可消费的消息
+const codeNoMessage = 7000
+
 // CommResp 通用返回
 type CommResp struct {
 	Code      int    `json:"code"`
@@ -30,3 +38,33 @@ type CommResp struct {
 func (resp CommResp) Error() string {
 	return fmt.Sprintf("request(%s) response=%d(%s)", resp.RequestID, resp.Code, resp.Message)
 }
+
+// DecodeFailure 批量接收时解码失败的消息，Message 的消息体保持接收时的原样，Queue 为消息所在的队列
+type DecodeFailure struct {
+	Queue   *Queue
+	Message Message
+	Err     error
+}
+
+// BatchDecodeError 批量接收时部分消息解码失败(如 DecryptError)。失败的消息不在返回的消息列表中，
+// 列表中的消息都已正常解码；失败的消息需要调用方删除或处理，否则会在可见性超时后再次被接收
+type BatchDecodeError struct {
+	Failures []DecodeFailure
+}
+
+func (this *BatchDecodeError) Error() string {
+	msgs := make([]string, len(this.Failures))
+	for i, f := range this.Failures {
+		msgs[i] = fmt.Sprintf("%s: %v", f.Message.MsgId, f.Err)
+	}
+	return fmt.Sprintf("%d message(s) failed to decode: %s", len(this.Failures), strings.Join(msgs, "; "))
+}
+
+// Unwrap 使 errors.As 可以取出其中的 DecryptError 等错误
+func (this *BatchDecodeError) Unwrap() []error {
+	errs := make([]error, len(this.Failures))
+	for i, f := range this.Failures {
+		errs[i] = f.Err
+	}
+	return errs
+}
@@ -0,0 +1,206 @@
+package cmq_go
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Middleware 包装处理函数，在处理前后增加通用逻辑
+type Middleware func(next Handler) Handler
+
+// Chain 用middlewares依次包装handler，第一个在最外层
+func Chain(handler Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// PanicError 处理函数panic，按处理失败处理
+type PanicError struct {
+	MsgId string
+	Value interface{}
+	Stack []byte
+}
+
+func (this *PanicError) Error() string {
+	return fmt.Sprintf("message %s: handler panic: %v", this.MsgId, this.Value)
+}
+
+// Recover 捕获处理函数的panic并返回 PanicError
+func Recover() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg Message) (err error) {
+			defer func() {
+				if v := recover(); v != nil {
+					err = &PanicError{MsgId: msg.MsgId, Value: v, Stack: debug.Stack()}
+				}
+			}()
+			return next(ctx, msg)
+		}
+	}
+}
+
+// Logging 用结构化日志记录每条消息的处理结果，成功为Debug级别，失败为Error级别；logger为nil时使用 slog.Default()
+func Logging(logger *slog.Logger) Middleware {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg Message) error {
+			start := time.Now()
+			err := next(ctx, msg)
+			attrs := []slog.Attr{
+				slog.String("msgId", msg.MsgId),
+				slog.Int("dequeueCount", msg.DequeueCount),
+				slog.Duration("duration", time.Since(start)),
+			}
+			if trace, ok := TraceFromContext(ctx); ok {
+				attrs = append(attrs, slog.String("traceId", trace.TraceID))
+			}
+			if err != nil {
+				logger.LogAttrs(ctx, slog.LevelError, "message handling failed", append(attrs, slog.Any("error", err))...)
+			} else {
+				logger.LogAttrs(ctx, slog.LevelDebug, "message handled", attrs...)
+			}
+			return err
+		}
+	}
+}
+
+// Metrics 每条消息处理完成后调用observe，可用于对接监控系统；HandlerMetrics.Observe 提供内存中的统计
+func Metrics(observe func(msg Message, duration time.Duration, err error)) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg Message) error {
+			start := time.Now()
+			err := next(ctx, msg)
+			observe(msg, time.Since(start), err)
+			return err
+		}
+	}
+}
+
+// HandlerMetrics 处理函数的统计，配合 Metrics(metrics.Observe) 使用
+type HandlerMetrics struct {
+	handled int64
+	failed  int64
+	panics  int64
+
+	mu           sync.Mutex
+	totalLatency time.Duration
+	maxLatency   time.Duration
+}
+
+// HandlerStats 处理函数统计
+type HandlerStats struct {
+	/** 处理成功的消息数 */
+	Handled int64
+	/** 处理失败的消息数，包括panic */
+	Failed int64
+	/** 处理函数panic的次数，需要 Recover 在 Metrics 内层 */
+	Panics int64
+	/** 平均处理耗时 */
+	AvgLatency time.Duration
+	/** 最长处理耗时 */
+	MaxLatency time.Duration
+}
+
+func (this *HandlerMetrics) Observe(msg Message, duration time.Duration, err error) {
+	if err == nil {
+		atomic.AddInt64(&this.handled, 1)
+	} else {
+		atomic.AddInt64(&this.failed, 1)
+		if _, ok := err.(*PanicError); ok {
+			atomic.AddInt64(&this.panics, 1)
+		}
+	}
+	this.mu.Lock()
+	this.totalLatency += duration
+	if duration > this.maxLatency {
+		this.maxLatency = duration
+	}
+	this.mu.Unlock()
+}
+
+func (this *HandlerMetrics) Stats() HandlerStats {
+	stats := HandlerStats{
+		Handled: atomic.LoadInt64(&this.handled),
+		Failed:  atomic.LoadInt64(&this.failed),
+		Panics:  atomic.LoadInt64(&this.panics),
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if n := stats.Handled + stats.Failed; n > 0 {
+		stats.AvgLatency = this.totalLatency / time.Duration(n)
+	}
+	stats.MaxLatency = this.maxLatency
+	return stats
+}
+
+// TraceContext 从消息头 traceparent/tracestate 解析的W3C Trace Context
+type TraceContext struct {
+	TraceID    string
+	ParentID   string
+	TraceFlags string
+	TraceState string
+}
+
+// TraceParent 格式化为 traceparent 消息头
+func (this TraceContext) TraceParent() string {
+	return "00-" + this.TraceID + "-" + this.ParentID + "-" + this.TraceFlags
+}
+
+type traceKey struct{}
+
+// TraceFromContext 返回 Trace 放入ctx的 TraceContext
+func TraceFromContext(ctx context.Context) (TraceContext, bool) {
+	trace, ok := ctx.Value(traceKey{}).(TraceContext)
+	return trace, ok
+}
+
+// ParseTraceParent 解析 traceparent 消息头，格式不正确时返回false
+func ParseTraceParent(traceParent string) (TraceContext, bool) {
+	parts := strings.Split(traceParent, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return TraceContext{}, false
+	}
+	for _, part := range parts[:4] {
+		if strings.Trim(part, "0123456789abcdef") != "" {
+			return TraceContext{}, false
+		}
+	}
+	if strings.Trim(parts[1], "0") == "" || strings.Trim(parts[2], "0") == "" {
+		return TraceContext{}, false
+	}
+	return TraceContext{TraceID: parts[1], ParentID: parts[2], TraceFlags: parts[3]}, true
+}
+
+// Trace 从信封消息头中提取 traceparent/tracestate 放入ctx，通过 TraceFromContext 取得
+func Trace() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg Message) error {
+			if trace, ok := ParseTraceParent(msg.Headers[HeaderTraceParent]); ok {
+				trace.TraceState = msg.Headers[HeaderTraceState]
+				ctx = context.WithValue(ctx, traceKey{}, trace)
+			}
+			return next(ctx, msg)
+		}
+	}
+}
+
+// Timeout 限制每条消息的处理时间，超时后ctx被取消，处理函数需要响应ctx
+func Timeout(timeout time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg Message) error {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			return next(ctx, msg)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package cmq_go
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MultiConsumer 按权重轮流从多个队列非阻塞地批量接收消息，交给各队列的处理函数，
+// 所有队列共用同一组并发位置和接收速率限制
+type MultiConsumer struct {
+	/** 所有队列共用的同时处理的消息数，默认1 */
+	Concurrency int
+	/** 每次 BatchReceiveMessage 最多接收的消息数，默认16 */
+	BatchSize int
+	/** 每秒最多接收的消息数，<=0时不限制 */
+	RateLimit float64
+	/** 速率限制允许的突发消息数，默认等于 BatchSize */
+	Burst int
+	/** 队列为空后暂停接收该队列的时长，默认1秒 */
+	IdleBackoff time.Duration
+	/** 接收失败后暂停接收该队列的时长，默认1秒 */
+	ErrorBackoff time.Duration
+
+	mu     sync.Mutex
+	queues []*multiQueue
+}
+
+type multiQueue struct {
+	consumer *Consumer
+	weight   int
+	// 平滑加权轮询的当前权重
+	current int
+	idle    time.Time
+}
+
+func NewMultiConsumer() *MultiConsumer {
+	return &MultiConsumer{
+		Concurrency:  1,
+		BatchSize:    16,
+		IdleBackoff:  time.Second,
+		ErrorBackoff: time.Second,
+	}
+}
+
+// Add 注册队列及其处理函数，weight 越大被接收的次数越多(<=0时为1)。
+// 返回的 Consumer 可以设置 OnError、Acker、MaxDeliveries、DeadLetter、Retry、PartitionKey 等处理相关的参数，
+// Concurrency、BatchSize 等接收相关的参数由 MultiConsumer 决定，不要单独调用其 Run
+func (this *MultiConsumer) Add(queue *Queue, weight int, handler Handler) *Consumer {
+	if weight <= 0 {
+		weight = 1
+	}
+	consumer := NewConsumer(queue, handler)
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.queues = append(this.queues, &multiQueue{consumer: consumer, weight: weight})
+	return consumer
+}
+
+// next 在没有暂停的队列中按平滑加权轮询选出下一个接收的队列；全部暂停时返回nil和最早恢复前的等待时间
+func (this *MultiConsumer) next() (*multiQueue, time.Duration) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	now := time.Now()
+	var picked *multiQueue
+	var wait time.Duration = -1
+	total := 0
+	for _, q := range this.queues {
+		if d := q.idle.Sub(now); d > 0 {
+			if wait < 0 || d < wait {
+				wait = d
+			}
+			continue
+		}
+		q.current += q.weight
+		total += q.weight
+		if picked == nil || q.current > picked.current {
+			picked = q
+		}
+	}
+	if picked == nil {
+		if wait < 0 {
+			wait = this.IdleBackoff
+		}
+		return nil, wait
+	}
+	picked.current -= total
+	return picked, 0
+}
+
+func (this *MultiConsumer) pause(q *multiQueue, d time.Duration) {
+	this.mu.Lock()
+	q.idle = time.Now().Add(d)
+	this.mu.Unlock()
+}
+
+// Run 循环接收并处理消息，ctx取消后停止接收，等待处理中的消息完成后返回ctx.Err()
+func (this *MultiConsumer) Run(ctx context.Context) error {
+	concurrency := this.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	batchSize := this.BatchSize
+	if batchSize <= 0 || batchSize > 16 {
+		batchSize = 16
+	}
+	var limiter *rateLimiter
+	if this.RateLimit > 0 {
+		burst := this.Burst
+		if burst < batchSize {
+			burst = batchSize
+		}
+		limiter = newRateLimiter(this.RateLimit, burst)
+	}
+
+	slots := make(chan struct{}, concurrency)
+	handlerCtx := context.WithoutCancel(ctx)
+	var wg sync.WaitGroup
+	this.mu.Lock()
+	for _, q := range this.queues {
+		defer q.consumer.startAcker(handlerCtx)()
+	}
+	this.mu.Unlock()
+	defer wg.Wait()
+
+	for ctx.Err() == nil {
+		q, wait := this.next()
+		if q == nil {
+			sleepContext(ctx, wait)
+			continue
+		}
+		n := acquireSlots(ctx, slots, batchSize)
+		if n == 0 {
+			break
+		}
+		if !limiter.wait(ctx, n) {
+			releaseSlots(slots, n)
+			break
+		}
+		msgs, err := q.consumer.queue.batchReceiveMessage(ctx, n, 0)
+		releaseSlots(slots, n-len(msgs))
+		limiter.refund(n - len(msgs))
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			if isNoMessage(err) {
+				this.pause(q, this.IdleBackoff)
+			} else {
+				q.consumer.report(nil, err)
+				this.pause(q, this.ErrorBackoff)
+			}
+			continue
+		}
+		q.consumer.dispatch(handlerCtx, msgs, &wg, slots)
+	}
+	return ctx.Err()
+}
+
+// rateLimiter 令牌桶，每秒补充rate个令牌，最多积累burst个
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// wait 取走n个令牌，令牌不足时等待补充；ctx取消时返回false。nil表示不限制
+func (this *rateLimiter) wait(ctx context.Context, n int) bool {
+	if this == nil {
+		return ctx.Err() == nil
+	}
+	this.mu.Lock()
+	now := time.Now()
+	this.tokens += now.Sub(this.last).Seconds() * this.rate
+	if this.tokens > this.burst {
+		this.tokens = this.burst
+	}
+	this.last = now
+	this.tokens -= float64(n)
+	var d time.Duration
+	if this.tokens < 0 {
+		d = time.Duration(-this.tokens / this.rate * float64(time.Second))
+	}
+	this.mu.Unlock()
+
+	if d > 0 {
+		sleepContext(ctx, d)
+	}
+	if ctx.Err() != nil {
+		this.refund(n)
+		return false
+	}
+	return true
+}
+
+// refund 归还没有用到的令牌
+func (this *rateLimiter) refund(n int) {
+	if this == nil || n <= 0 {
+		return
+	}
+	this.mu.Lock()
+	this.tokens += float64(n)
+	this.mu.Unlock()
+}
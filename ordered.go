@@ -0,0 +1,68 @@
+package cmq_go
+
+import (
+	"context"
+	"sync"
+)
+
+// HeaderPartitionKey 信封中的分区键，配合 PartitionByHeader 使用
+const HeaderPartitionKey = "partition-key"
+
+// PartitionByHeader 从信封消息头中读取分区键
+func PartitionByHeader(name string) func(msg Message) string {
+	return func(msg Message) string {
+		return msg.Headers[name]
+	}
+}
+
+// partitions 记录正在处理的分区以及排队等待的消息
+type partitions struct {
+	mu      sync.Mutex
+	pending map[string][]Message
+}
+
+// dispatchOrdered 分区空闲时启动一个goroutine处理该分区，分区忙时消息排在该分区之后。
+// 消息在接收的goroutine中解码，以便按消息体或消息头计算分区键；排队中的消息同样占用并发位置
+func (this *Consumer) dispatchOrdered(ctx context.Context, msg Message, wg *sync.WaitGroup, slots chan struct{}) {
+	if !this.prepare(&msg) {
+		releaseSlots(slots, 1)
+		return
+	}
+	key := this.PartitionKey(msg)
+
+	p := &this.partitions
+	if key != "" {
+		p.mu.Lock()
+		if queue, busy := p.pending[key]; busy {
+			p.pending[key] = append(queue, msg)
+			p.mu.Unlock()
+			return
+		}
+		if p.pending == nil {
+			p.pending = make(map[string][]Message)
+		}
+		p.pending[key] = nil
+		p.mu.Unlock()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			this.handle(ctx, msg)
+			releaseSlots(slots, 1)
+			if key == "" {
+				return
+			}
+			p.mu.Lock()
+			queue := p.pending[key]
+			if len(queue) == 0 {
+				delete(p.pending, key)
+				p.mu.Unlock()
+				return
+			}
+			msg, p.pending[key] = queue[0], queue[1:]
+			p.mu.Unlock()
+		}
+	}()
+}
@@ -0,0 +1,129 @@
+// Package outbox 实现事务性发件箱：消息在业务事务内写入数据库表，由 Relay 读取后投递到CMQ，
+// 业务数据与待发消息同时提交或同时回滚，投递语义为至少一次
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	kindQueue = "queue"
+	kindTopic = "topic"
+)
+
+// Dialect 不同数据库的建表语句与占位符差异
+type Dialect struct {
+	name        string
+	createTable string
+	placeholder func(n int) string
+}
+
+func questionMark(int) string { return "?" }
+
+var (
+	SQLite = Dialect{
+		name: "sqlite",
+		createTable: `CREATE TABLE IF NOT EXISTS %s (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	kind VARCHAR(8) NOT NULL,
+	target VARCHAR(64) NOT NULL,
+	body TEXT NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	last_error TEXT,
+	next_attempt_at BIGINT NOT NULL DEFAULT 0,
+	created_at BIGINT NOT NULL
+)`,
+		placeholder: questionMark,
+	}
+	MySQL = Dialect{
+		name: "mysql",
+		createTable: `CREATE TABLE IF NOT EXISTS %s (
+	id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	kind VARCHAR(8) NOT NULL,
+	target VARCHAR(64) NOT NULL,
+	body MEDIUMTEXT NOT NULL,
+	attempts INT NOT NULL DEFAULT 0,
+	last_error TEXT,
+	next_attempt_at BIGINT NOT NULL DEFAULT 0,
+	created_at BIGINT NOT NULL
+)`,
+		placeholder: questionMark,
+	}
+	Postgres = Dialect{
+		name: "postgres",
+		createTable: `CREATE TABLE IF NOT EXISTS %s (
+	id BIGSERIAL PRIMARY KEY,
+	kind VARCHAR(8) NOT NULL,
+	target VARCHAR(64) NOT NULL,
+	body TEXT NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	last_error TEXT,
+	next_attempt_at BIGINT NOT NULL DEFAULT 0,
+	created_at BIGINT NOT NULL
+)`,
+		placeholder: func(n int) string { return "$" + strconv.Itoa(n) },
+	}
+)
+
+func (this Dialect) String() string {
+	return this.name
+}
+
+// Schema 返回发件箱表的建表语句
+func Schema(dialect Dialect, table string) string {
+	return fmt.Sprintf(dialect.createTable, table)
+}
+
+// Outbox 发件箱表，写入操作都在调用方的事务中执行
+type Outbox struct {
+	dialect Dialect
+	table   string
+}
+
+func New(dialect Dialect, table string) *Outbox {
+	return &Outbox{dialect: dialect, table: table}
+}
+
+// CreateTable 创建发件箱表(已存在时忽略)
+func (this *Outbox) CreateTable(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, Schema(this.dialect, this.table))
+	return err
+}
+
+// SendMessage 在事务tx中写入一条发往队列queueName的消息，事务提交后由 Relay 投递
+func (this *Outbox) SendMessage(ctx context.Context, tx *sql.Tx, queueName, msgBody string) error {
+	return this.insert(ctx, tx, kindQueue, queueName, msgBody)
+}
+
+// PublishMessage 在事务tx中写入一条发往主题topicName的消息，事务提交后由 Relay 投递
+func (this *Outbox) PublishMessage(ctx context.Context, tx *sql.Tx, topicName, msgBody string) error {
+	return this.insert(ctx, tx, kindTopic, topicName, msgBody)
+}
+
+func (this *Outbox) insert(ctx context.Context, tx *sql.Tx, kind, target, msgBody string) error {
+	if target == "" {
+		return fmt.Errorf("outbox: %s name is empty", kind)
+	}
+	query := fmt.Sprintf("INSERT INTO %s (kind, target, body, created_at) VALUES (%s, %s, %s, %s)",
+		this.table, this.ph(1), this.ph(2), this.ph(3), this.ph(4))
+	_, err := tx.ExecContext(ctx, query, kind, target, msgBody, time.Now().Unix())
+	return err
+}
+
+func (this *Outbox) ph(n int) string {
+	return this.dialect.placeholder(n)
+}
+
+// in 生成 "IN (?, ?, ...)" 形式的条件，占位符从start开始编号
+func (this *Outbox) in(start, count int) string {
+	phs := make([]string, count)
+	for i := range phs {
+		phs[i] = this.ph(start + i)
+	}
+	return "IN (" + strings.Join(phs, ", ") + ")"
+}
@@ -0,0 +1,250 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	cmq_go "github.com/glutwins/cmq-go"
+)
+
+// 批量发送接口单次最多16条消息
+const maxBatch = 16
+
+type row struct {
+	id     int64
+	kind   string
+	target string
+	body   string
+}
+
+// Relay 按写入顺序读取发件箱中的消息，通过 BatchSendMessage/BatchPublishMessage 投递后删除。
+// 投递成功但删除失败时消息会被再次投递，消费方需要能处理重复消息；
+// 投递失败的消息在 RetryDelay 之后重试，不阻塞之后的消息，因此重试的消息可能晚于之后写入的消息到达；
+// 失败 MaxAttempts 次后不再投递，保留在表中(last_error 记录最后一次错误)等待人工处理。
+// 同一张表只应运行一个 Relay，否则同一消息可能被并发投递
+type Relay struct {
+	db     *sql.DB
+	outbox *Outbox
+
+	/** 每轮最多读取的消息数，默认256 */
+	BatchSize int
+	/** 发件箱为空时的轮询间隔，默认1秒 */
+	Interval time.Duration
+	/** 投递失败后下次重试前的等待时间，默认10秒 */
+	RetryDelay time.Duration
+	/** 最多投递次数，达到后不再投递，<=0时不限制，默认10 */
+	MaxAttempts int
+
+	mu     sync.RWMutex
+	queues map[string]*cmq_go.Queue
+	topics map[string]*cmq_go.Topic
+}
+
+func NewRelay(db *sql.DB, outbox *Outbox) *Relay {
+	return &Relay{
+		db:          db,
+		outbox:      outbox,
+		BatchSize:   256,
+		Interval:    time.Second,
+		RetryDelay:  10 * time.Second,
+		MaxAttempts: 10,
+		queues:      make(map[string]*cmq_go.Queue),
+		topics:      make(map[string]*cmq_go.Topic),
+	}
+}
+
+// RegisterQueue 指定投递到queueName时使用的队列，未注册目标的消息会保留在表中并记录错误
+func (this *Relay) RegisterQueue(queueName string, queue *cmq_go.Queue) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.queues[queueName] = queue
+}
+
+func (this *Relay) RegisterTopic(topicName string, topic *cmq_go.Topic) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.topics[topicName] = topic
+}
+
+// Run 循环投递直到ctx取消
+func (this *Relay) Run(ctx context.Context) error {
+	for {
+		n, err := this.Flush(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if n > 0 && err == nil {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(this.Interval):
+		}
+	}
+}
+
+// Flush 投递一轮消息，返回成功投递的条数。同一目标的消息按写入顺序投递；
+// 某批因临时错误失败后该目标本轮不再继续，因其它错误失败时逐条重试该批，只有出错的消息记为失败
+func (this *Relay) Flush(ctx context.Context) (int, error) {
+	rows, err := this.load(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var targets []string
+	groups := make(map[string][]row)
+	for _, r := range rows {
+		key := r.kind + "/" + r.target
+		if _, found := groups[key]; !found {
+			targets = append(targets, key)
+		}
+		groups[key] = append(groups[key], r)
+	}
+
+	delivered := 0
+	var firstErr error
+	for _, key := range targets {
+		group := groups[key]
+		for len(group) > 0 {
+			n := len(group)
+			if n > maxBatch {
+				n = maxBatch
+			}
+			batch := group[:n]
+			group = group[n:]
+
+			err := this.deliver(batch)
+			if err == nil {
+				if err = this.remove(ctx, batch); err != nil {
+					return delivered, err
+				}
+				delivered += len(batch)
+				continue
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			if len(batch) == 1 || transient(err) {
+				this.markFailed(ctx, batch, err)
+				break
+			}
+			// 非临时错误通常由个别消息引起(如消息过大)，逐条重试，只有出错的消息记为失败
+			n, stop, err := this.deliverEach(ctx, batch)
+			delivered += n
+			if err != nil {
+				return delivered, err
+			}
+			if stop {
+				break
+			}
+		}
+	}
+	return delivered, firstErr
+}
+
+// deliverEach 逐条投递batch，返回成功的条数；遇到临时错误时剩余消息记为失败并返回stop
+func (this *Relay) deliverEach(ctx context.Context, batch []row) (int, bool, error) {
+	delivered := 0
+	for i := range batch {
+		one := batch[i : i+1]
+		if err := this.deliver(one); err != nil {
+			if transient(err) {
+				this.markFailed(ctx, batch[i:], err)
+				return delivered, true, nil
+			}
+			this.markFailed(ctx, one, err)
+			continue
+		}
+		if err := this.remove(ctx, one); err != nil {
+			return delivered, false, err
+		}
+		delivered++
+	}
+	return delivered, false, nil
+}
+
+func (this *Relay) load(ctx context.Context) ([]row, error) {
+	// 跳过等待重试和已达到最多投递次数的消息，以免失败的消息一直占据每轮读取的位置
+	where := "next_attempt_at <= " + this.outbox.ph(1)
+	args := []interface{}{time.Now().UnixNano() / int64(time.Millisecond)}
+	if this.MaxAttempts > 0 {
+		where += " AND attempts < " + this.outbox.ph(2)
+		args = append(args, this.MaxAttempts)
+	}
+	query := fmt.Sprintf("SELECT id, kind, target, body FROM %s WHERE %s ORDER BY id LIMIT %d", this.outbox.table, where, this.BatchSize)
+	rs, err := this.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+
+	var rows []row
+	for rs.Next() {
+		var r row
+		if err := rs.Scan(&r.id, &r.kind, &r.target, &r.body); err != nil {
+			return nil, err
+		}
+		rows = append(rows, r)
+	}
+	return rows, rs.Err()
+}
+
+func (this *Relay) deliver(batch []row) error {
+	bodys := make([]string, len(batch))
+	for i, r := range batch {
+		bodys[i] = r.body
+	}
+	kind, target := batch[0].kind, batch[0].target
+
+	this.mu.RLock()
+	queue, topic := this.queues[target], this.topics[target]
+	this.mu.RUnlock()
+
+	var err error
+	switch {
+	case kind == kindQueue && queue != nil:
+		_, err = queue.BatchSendMessage(bodys)
+	case kind == kindTopic && topic != nil:
+		_, err = topic.BatchPublishMessage(bodys)
+	default:
+		err = fmt.Errorf("%s %s is not registered", kind, target)
+	}
+	return err
+}
+
+// transient 判断错误是否为网络或服务端的临时故障，与消息内容无关
+func transient(err error) bool {
+	switch e := err.(type) {
+	case *cmq_go.HTTPError:
+		return e.StatusCode >= 500 || e.StatusCode == 429
+	case net.Error:
+		return true
+	}
+	return false
+}
+
+func ids(batch []row) []interface{} {
+	args := make([]interface{}, len(batch))
+	for i, r := range batch {
+		args[i] = r.id
+	}
+	return args
+}
+
+func (this *Relay) remove(ctx context.Context, batch []row) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE id %s", this.outbox.table, this.outbox.in(1, len(batch)))
+	_, err := this.db.ExecContext(ctx, query, ids(batch)...)
+	return err
+}
+
+func (this *Relay) markFailed(ctx context.Context, batch []row, cause error) {
+	query := fmt.Sprintf("UPDATE %s SET attempts = attempts + 1, last_error = %s, next_attempt_at = %s WHERE id %s",
+		this.outbox.table, this.outbox.ph(1), this.outbox.ph(2), this.outbox.in(3, len(batch)))
+	next := time.Now().Add(this.RetryDelay).UnixNano() / int64(time.Millisecond)
+	this.db.ExecContext(ctx, query, append([]interface{}{cause.Error(), next}, ids(batch)...)...)
+}
@@ -0,0 +1,92 @@
+package cmq_go
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// prefetch 预取缓冲：接收的消息最多比处理函数多 Consumer.Prefetch 条，
+// 消息在缓冲中等待空闲的处理位置，预计无法在 NextVisibleTime 之前处理完的消息直接丢弃，等待重新投递
+type prefetch struct {
+	concurrency int
+	workers     chan struct{}
+	// Run 的ctx，取消后缓冲中的消息不再处理
+	stop <-chan struct{}
+
+	// 处理耗时的指数移动平均
+	latency int64
+	// 最近一次收到消息时观察到的可见性超时
+	visibility int64
+	buffered   int64
+}
+
+func newPrefetch(ctx context.Context, concurrency int) *prefetch {
+	return &prefetch{
+		concurrency: concurrency,
+		workers:     make(chan struct{}, concurrency),
+		stop:        ctx.Done(),
+	}
+}
+
+func (this *prefetch) observeHandle(d time.Duration) {
+	latency := atomic.LoadInt64(&this.latency)
+	if latency == 0 {
+		latency = int64(d)
+	} else {
+		latency += (int64(d) - latency) / 8
+	}
+	atomic.StoreInt64(&this.latency, latency)
+}
+
+func (this *prefetch) observeReceive(msgs []Message, received time.Time) {
+	if len(msgs) == 0 {
+		return
+	}
+	if at := visibleAt(msgs[0]); !at.IsZero() {
+		atomic.StoreInt64(&this.visibility, int64(at.Sub(received)))
+	}
+}
+
+// limit 根据处理耗时和可见性超时限制本次接收的数量n，inUse 为已接收未处理完的消息数。
+// 缓冲中排在最后的消息也要能在可见性超时前处理完
+func (this *prefetch) limit(n, inUse int, margin time.Duration) int {
+	latency := time.Duration(atomic.LoadInt64(&this.latency))
+	visibility := time.Duration(atomic.LoadInt64(&this.visibility))
+	if latency <= 0 || visibility <= 0 {
+		return n
+	}
+	queued := 0
+	if remain := visibility - margin - latency; remain > 0 {
+		queued = int(time.Duration(this.concurrency) * remain / latency)
+	}
+	if max := this.concurrency + queued - inUse; n > max {
+		return max
+	}
+	return n
+}
+
+// acquire 等待空闲的处理位置，返回false表示消息不处理：Run已停止，或预计在消息重新可见前无法处理完
+func (this *prefetch) acquire(msg Message, margin time.Duration) (ok, expired bool) {
+	atomic.AddInt64(&this.buffered, 1)
+	defer atomic.AddInt64(&this.buffered, -1)
+	select {
+	case <-this.stop:
+		return false, false
+	default:
+	}
+	select {
+	case <-this.stop:
+		return false, false
+	case this.workers <- struct{}{}:
+	}
+	if at := visibleAt(msg); !at.IsZero() && time.Until(at)-margin < time.Duration(atomic.LoadInt64(&this.latency)) {
+		<-this.workers
+		return false, true
+	}
+	return true, false
+}
+
+func (this *prefetch) release() {
+	<-this.workers
+}
@@ -0,0 +1,210 @@
+package cmq_go
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 优先级队列的消费策略
+const (
+	// PriorityStrict 总是先消费高优先级队列，低优先级队列超过 StarvationTimeout 未被消费时优先消费一次
+	PriorityStrict = iota
+	// PriorityWeighted 按权重轮流决定先消费哪个队列，权重越大被优先消费的次数越多
+	PriorityWeighted
+)
+
+// PriorityQueue 用多个CMQ队列模拟消息优先级，每个优先级对应一个队列，数值越大优先级越高
+type PriorityQueue struct {
+	/** 消费策略，PriorityStrict 或 PriorityWeighted */
+	Strategy int
+	/** PriorityStrict 策略下低优先级队列允许的最长未消费时间，<=0时不做防饿死处理 */
+	StarvationTimeout time.Duration
+
+	mu     sync.Mutex
+	levels []*priorityLevel
+}
+
+type priorityLevel struct {
+	priority int
+	queue    *Queue
+	weight   int
+	// 平滑加权轮询的当前权重
+	current int
+	served  time.Time
+}
+
+// PriorityMessage 从优先级队列收到的消息，删除时需要使用对应的底层队列
+type PriorityMessage struct {
+	Message
+	Priority int
+	Queue    *Queue
+}
+
+func NewPriorityQueue(strategy int) *PriorityQueue {
+	return &PriorityQueue{Strategy: strategy}
+}
+
+// AddLevel 注册优先级priority对应的队列，weight 用于 PriorityWeighted 策略(<=0时为1)
+func (this *PriorityQueue) AddLevel(priority int, queue *Queue, weight int) {
+	if weight <= 0 {
+		weight = 1
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for _, l := range this.levels {
+		if l.priority == priority {
+			l.queue, l.weight = queue, weight
+			return
+		}
+	}
+	this.levels = append(this.levels, &priorityLevel{priority: priority, queue: queue, weight: weight, served: time.Now()})
+	sort.Slice(this.levels, func(i, j int) bool { return this.levels[i].priority > this.levels[j].priority })
+}
+
+// level 返回不高于priority的最高优先级队列，priority低于所有已注册优先级时返回最低优先级队列
+func (this *PriorityQueue) level(priority int) (*priorityLevel, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if len(this.levels) == 0 {
+		return nil, fmt.Errorf("priority queue has no levels")
+	}
+	for _, l := range this.levels {
+		if l.priority <= priority {
+			return l, nil
+		}
+	}
+	return this.levels[len(this.levels)-1], nil
+}
+
+func (this *PriorityQueue) SendMessage(msgBody string, priority int) (string, error) {
+	l, err := this.level(priority)
+	if err != nil {
+		return "", err
+	}
+	return l.queue.SendMessage(msgBody)
+}
+
+func (this *PriorityQueue) BatchSendMessage(msgBodys []string, priority int) ([]string, error) {
+	l, err := this.level(priority)
+	if err != nil {
+		return nil, err
+	}
+	return l.queue.BatchSendMessage(msgBodys)
+}
+
+func (this *PriorityQueue) DeleteMessage(msg PriorityMessage) error {
+	return msg.Queue.DeleteMessage(msg.ReceiptHandle)
+}
+
+// order 按消费策略返回本轮各队列的消费顺序
+func (this *PriorityQueue) order() []*priorityLevel {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	order := make([]*priorityLevel, len(this.levels))
+	copy(order, this.levels)
+	if len(order) == 0 {
+		return order
+	}
+
+	first := -1
+	switch this.Strategy {
+	case PriorityWeighted:
+		total := 0
+		for i, l := range order {
+			l.current += l.weight
+			total += l.weight
+			if first < 0 || l.current > order[first].current {
+				first = i
+			}
+		}
+		order[first].current -= total
+	default:
+		if this.StarvationTimeout > 0 {
+			for i := len(order) - 1; i > 0; i-- {
+				if time.Since(order[i].served) > this.StarvationTimeout {
+					first = i
+					break
+				}
+			}
+		}
+	}
+	if first > 0 {
+		l := order[first]
+		copy(order[1:first+1], order[:first])
+		order[0] = l
+	}
+	return order
+}
+
+// BatchReceiveMessage 按消费策略依次从各队列非阻塞地批量接收，直到收满numOfMsg条；
+// 所有队列都为空时在最高优先级队列上长轮询pollingWaitSeconds秒。
+// 与 Queue.BatchReceiveMessage 相同，解码失败的消息不在返回的列表中，而在 *BatchDecodeError 中；
+// 某个队列接收失败时其它队列的消息照常返回，错误与 BatchDecodeError 合并返回
+func (this *PriorityQueue) BatchReceiveMessage(numOfMsg, pollingWaitSeconds int) ([]PriorityMessage, error) {
+	order := this.order()
+	if len(order) == 0 {
+		return nil, fmt.Errorf("priority queue has no levels")
+	}
+
+	var msgs []PriorityMessage
+	var firstErr error
+	var failed *BatchDecodeError
+	receive := func(l *priorityLevel, wait int) {
+		batch, err := l.queue.BatchReceiveMessage(numOfMsg-len(msgs), wait)
+		var decodeErr *BatchDecodeError
+		switch {
+		case errors.As(err, &decodeErr):
+			if failed == nil {
+				failed = &BatchDecodeError{}
+			}
+			failed.Failures = append(failed.Failures, decodeErr.Failures...)
+		case err != nil && !isNoMessage(err) && firstErr == nil:
+			firstErr = err
+		}
+		if len(batch) > 0 {
+			this.mu.Lock()
+			l.served = time.Now()
+			this.mu.Unlock()
+		}
+		for _, msg := range batch {
+			msgs = append(msgs, PriorityMessage{Message: msg, Priority: l.priority, Queue: l.queue})
+		}
+	}
+
+	for _, l := range order {
+		if len(msgs) >= numOfMsg {
+			break
+		}
+		receive(l, 0)
+	}
+	if len(msgs) == 0 && pollingWaitSeconds != 0 {
+		this.mu.Lock()
+		highest := this.levels[0]
+		this.mu.Unlock()
+		receive(highest, pollingWaitSeconds)
+	}
+	var err error
+	switch {
+	case failed != nil && firstErr != nil:
+		err = errors.Join(failed, firstErr)
+	case failed != nil:
+		err = failed
+	case firstErr != nil:
+		err = firstErr
+	}
+	if len(msgs) == 0 {
+		if err != nil {
+			return nil, err
+		}
+		return nil, &CommResp{Code: codeNoMessage, Message: "no message"}
+	}
+	return msgs, err
+}
+
+func isNoMessage(err error) bool {
+	resp, ok := err.(*CommResp)
+	return ok && resp.Code == codeNoMessage
+}
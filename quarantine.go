@@ -0,0 +1,163 @@
+package cmq_go
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// QuarantineRecord 隔离文件中的一行，格式与 FileDeadLetter 相同
+type QuarantineRecord struct {
+	Message Message        `json:"message"`
+	Info    DeadLetterInfo `json:"deadLetter"`
+}
+
+// Quarantine 把无法处理的消息(解码失败或多次处理失败)连同失败原因以JSON行的格式写入本地文件，
+// 文件超过 MaxSize 后轮转为 path.1、path.2 ...，最多保留 MaxFiles 个。可以作为 DeadLetter 或 Consumer.Quarantine 使用
+type Quarantine struct {
+	/** 单个文件的最大字节数，默认64MB，<=0时不轮转 */
+	MaxSize int64
+	/** 最多保留的轮转文件数(不含当前文件)，默认5 */
+	MaxFiles int
+
+	path string
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func NewQuarantine(path string) (*Quarantine, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Quarantine{MaxSize: 64 << 20, MaxFiles: 5, path: path, f: f, size: fi.Size()}, nil
+}
+
+func (this *Quarantine) DeadLetter(msg Message, info DeadLetterInfo) error {
+	line, err := json.Marshal(QuarantineRecord{Message: msg, Info: info})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.MaxSize > 0 && this.size > 0 && this.size+int64(len(line)) > this.MaxSize {
+		if err = this.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := this.f.Write(line)
+	this.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return this.f.Sync()
+}
+
+// rotate 把当前文件改名为 path.1，已有的轮转文件序号依次加1，超过 MaxFiles 的删除
+func (this *Quarantine) rotate() error {
+	if err := this.f.Close(); err != nil {
+		return err
+	}
+	maxFiles := this.MaxFiles
+	if maxFiles <= 0 {
+		maxFiles = 5
+	}
+	os.Remove(rotatedPath(this.path, maxFiles))
+	for i := maxFiles - 1; i >= 1; i-- {
+		os.Rename(rotatedPath(this.path, i), rotatedPath(this.path, i+1))
+	}
+	if err := os.Rename(this.path, rotatedPath(this.path, 1)); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(this.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	this.f, this.size = f, 0
+	return nil
+}
+
+func rotatedPath(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
+
+func (this *Quarantine) Close() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.f.Close()
+}
+
+// ReadQuarantine 按写入顺序读取path及其轮转文件中的所有记录，也可以读取 FileDeadLetter 的文件
+func ReadQuarantine(path string) ([]QuarantineRecord, error) {
+	var paths []string
+	for i := 1; ; i++ {
+		if _, err := os.Stat(rotatedPath(path, i)); err != nil {
+			break
+		}
+		paths = append([]string{rotatedPath(path, i)}, paths...)
+	}
+	paths = append(paths, path)
+
+	var records []QuarantineRecord
+	for _, p := range paths {
+		f, err := os.Open(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return records, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 16<<20)
+		for scanner.Scan() {
+			var record QuarantineRecord
+			if err = json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				f.Close()
+				return records, fmt.Errorf("%s: %v", p, err)
+			}
+			records = append(records, record)
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return records, err
+		}
+	}
+	return records, nil
+}
+
+// Resubmit 把选出的隔离记录重新发送到queue，重试次数从头开始。
+// 解码失败的记录按收到的原始内容发送，不再经过 queue 的编码设置；
+// 返回已发送的msgId，出错时停止并返回出错前的结果
+func Resubmit(ctx context.Context, queue *Queue, records []QuarantineRecord) ([]string, error) {
+	msgIds := make([]string, 0, len(records))
+	for _, record := range records {
+		var msgId string
+		var err error
+		if record.Info.Raw {
+			msgId, err = _sendMessage(ctx, queue.client, record.Message.MsgBody, queue.queueName, 0)
+		} else {
+			headers := make(map[string]string, len(record.Message.Headers))
+			for k, v := range record.Message.Headers {
+				headers[k] = v
+			}
+			delete(headers, HeaderAttempt)
+			msgId, err = queue.deliver(ctx, record.Message.MsgBody, headers, 0)
+		}
+		if err != nil {
+			return msgIds, err
+		}
+		msgIds = append(msgIds, msgId)
+	}
+	return msgIds, nil
+}
@@ -1,8 +1,10 @@
 package cmq_go
 
 import (
+	"context"
 	"fmt"
 	"strconv"
+	"time"
 )
 
 type QueueMeta struct {
@@ -37,6 +39,11 @@ type QueueMeta struct {
 type Queue struct {
 	queueName string
 	client    *CMQClient
+	codec     codec
+	sizeCheck *sizeCheck
+	spool     *Spool
+	pressure  *backpressure
+	dedup     *dedup
 }
 
 func NewQueue(queueName string, client *CMQClient) (queue *Queue) {
@@ -94,15 +101,124 @@ func (this *Queue) GetQueueAttributes() (queueMeta QueueMeta, err error) {
 	return
 }
 
+// SetEnvelope 开启后发送的消息都使用信封格式，接收时总会尝试解析信封
+func (this *Queue) SetEnvelope(enabled bool) {
+	this.codec.envelope = enabled
+}
+
+// SetCompression 消息体长度达到threshold(<=0时使用DefaultCompressThreshold)时使用c压缩，c为nil时关闭压缩
+func (this *Queue) SetCompression(c Compressor, threshold int) {
+	this.codec.setCompression(c, threshold)
+}
+
+func (this *Queue) CompressionStats() CompressionStats {
+	return this.codec.compressionStats()
+}
+
+// SetClaimCheck 编码后的消息体超过threshold(<=0时使用DefaultClaimCheckThreshold)时存入store，消息只携带引用，store为nil时关闭
+func (this *Queue) SetClaimCheck(store BlobStore, threshold int) {
+	this.codec.setClaimCheck(store, threshold)
+}
+
+// SetEncryption 使用keys提供的当前密钥以AES-GCM加密消息体，接收时按消息头中的密钥ID解密，keys为nil时关闭
+func (this *Queue) SetEncryption(keys KeyProvider) {
+	this.codec.keys = keys
+}
+
+// SetSizeCheck 发送前按队列的 MaxMsgSize 在本地校验消息体长度，MaxMsgSize 缓存ttl后重新获取，ttl<=0时关闭
+func (this *Queue) SetSizeCheck(ttl time.Duration) {
+	if ttl <= 0 {
+		this.sizeCheck = nil
+		return
+	}
+	this.sizeCheck = &sizeCheck{ttl: ttl}
+}
+
+// SetSpool 发送遇到网络错误或服务端5xx时把消息写入本地暂存区，由 Spool.Run 在恢复后转发，
+// 此时发送接口返回空的msgId和nil错误。spool为nil时关闭
+func (this *Queue) SetSpool(spool *Spool) {
+	this.spool = spool
+	if spool != nil {
+		spool.register(spoolKindQueue, this.queueName, this.client)
+	}
+}
+
+// SetBackpressure 按队列堆积情况对发送限流，conf为nil时关闭
+func (this *Queue) SetBackpressure(conf *Backpressure) {
+	if conf == nil {
+		this.pressure = nil
+		return
+	}
+	this.pressure = newBackpressure(*conf)
+}
+
+func (this *Queue) BackpressureStats() BackpressureStats {
+	if this.pressure == nil {
+		return BackpressureStats{}
+	}
+	return this.pressure.stats()
+}
+
+// SetDedup 开启生产端去重，window(<=0时使用DefaultDedupWindow)内去重键相同的消息不再发送，直接返回第一次的msgId，
+// 第一次发送仍在进行或结果未知时返回空的msgId。store 不是 AtomicDedupStore(如 SQLDedupStore)时只在发送成功后记录，
+// 并发发送或超时后重试的消息仍会重复发送，需要可靠去重时消费端应使用 Idempotent 按 HeaderDedupKey 去重。store为nil时关闭
+func (this *Queue) SetDedup(store DedupStore, window time.Duration) {
+	this.dedup = newDedup(store, window)
+}
+
 func (this *Queue) SendMessage(msgBody string) (string, error) {
-	return _sendMessage(this.client, msgBody, this.queueName, 0)
+	return this.sendMessage(context.Background(), msgBody, nil, 0)
 }
 
 func (this *Queue) SendDelayMessage(msgBody string, delaySeconds int) (string, error) {
-	return _sendMessage(this.client, msgBody, this.queueName, delaySeconds)
+	return this.sendMessage(context.Background(), msgBody, nil, delaySeconds)
+}
+
+// SendMessageWithHeaders 以信封格式发送带消息头的消息
+func (this *Queue) SendMessageWithHeaders(msgBody string, headers map[string]string) (string, error) {
+	return this.sendMessage(context.Background(), msgBody, headers, 0)
+}
+
+// SendMessageWithDedupKey 发送带去重键的消息，开启 SetDedup 时窗口内相同去重键的消息只发送一次
+func (this *Queue) SendMessageWithDedupKey(msgBody, dedupKey string) (string, error) {
+	return this.sendMessage(context.Background(), msgBody, map[string]string{HeaderDedupKey: dedupKey}, 0)
 }
 
-func _sendMessage(client *CMQClient, msgBody, queueName string, delaySeconds int) (messageId string, err error) {
+func (this *Queue) sendMessage(ctx context.Context, msgBody string, headers map[string]string, delaySeconds int) (string, error) {
+	key := headers[HeaderDedupKey]
+	msgId, dup, reserved := this.dedup.reserve(this.queueName, key)
+	if dup {
+		return msgId, nil
+	}
+	msgId, err := this.deliver(ctx, msgBody, headers, delaySeconds)
+	this.dedup.finish(this.queueName, key, msgId, err, reserved)
+	return msgId, err
+}
+
+func (this *Queue) deliver(ctx context.Context, msgBody string, headers map[string]string, delaySeconds int) (string, error) {
+	body, err := this.codec.encode(msgBody, headers)
+	if err != nil {
+		return "", err
+	}
+	if err = this.checkSize(body); err != nil {
+		return "", err
+	}
+	if this.pressure != nil {
+		if err = this.pressure.admit(ctx, this); err != nil {
+			return "", err
+		}
+	}
+	if this.spool != nil && this.spool.pending() {
+		return "", this.spool.append(newSpoolRecord(spoolKindQueue, this.queueName, body, delaySeconds, nil))
+	}
+	msgId, err := _sendMessage(ctx, this.client, body, this.queueName, delaySeconds)
+	if err != nil && this.spool != nil && isTransient(ctx, err) {
+		return "", this.spool.append(newSpoolRecord(spoolKindQueue, this.queueName, body, delaySeconds, nil))
+	}
+	return msgId, err
+}
+
+func _sendMessage(ctx context.Context, client *CMQClient, msgBody, queueName string, delaySeconds int) (messageId string, err error) {
 	param := make(map[string]string)
 	param["queueName"] = queueName
 	param["msgBody"] = msgBody
@@ -113,7 +229,7 @@ func _sendMessage(client *CMQClient, msgBody, queueName string, delaySeconds int
 		MsgID string `json:"msgId"`
 	}
 
-	if err = client.call("SendMessage", param, &resp); err != nil {
+	if err = client.callContext(ctx, "SendMessage", param, &resp); err != nil {
 		return
 	}
 
@@ -125,11 +241,42 @@ func _sendMessage(client *CMQClient, msgBody, queueName string, delaySeconds int
 }
 
 func (this *Queue) BatchSendMessage(msgBodys []string) ([]string, error) {
-	return _batchSendMessage(this.client, msgBodys, this.queueName, 0)
+	return this.batchSendMessage(msgBodys, nil, 0)
 }
 
 func (this *Queue) BatchSendDelayMessage(msgBodys []string, delaySeconds int) ([]string, error) {
-	return _batchSendMessage(this.client, msgBodys, this.queueName, delaySeconds)
+	return this.batchSendMessage(msgBodys, nil, delaySeconds)
+}
+
+func (this *Queue) batchSendMessage(msgBodys []string, headers map[string]string, delaySeconds int) ([]string, error) {
+	bodys, err := this.codec.encodeAll(msgBodys, headers)
+	if err != nil {
+		return nil, err
+	}
+	if err = this.checkBatchSize(bodys); err != nil {
+		return nil, err
+	}
+	if this.pressure != nil {
+		if err = this.pressure.admit(context.Background(), this); err != nil {
+			return nil, err
+		}
+	}
+	if this.spool != nil && this.spool.pending() {
+		return nil, this.spoolAll(bodys, delaySeconds)
+	}
+	msgIds, err := _batchSendMessage(this.client, bodys, this.queueName, delaySeconds)
+	if err != nil && this.spool != nil && isTransient(context.Background(), err) {
+		return nil, this.spoolAll(bodys, delaySeconds)
+	}
+	return msgIds, err
+}
+
+func (this *Queue) spoolAll(bodys []string, delaySeconds int) error {
+	records := make([]spoolRecord, len(bodys))
+	for i, body := range bodys {
+		records[i] = newSpoolRecord(spoolKindQueue, this.queueName, body, delaySeconds, nil)
+	}
+	return this.spool.append(records...)
 }
 
 func _batchSendMessage(client *CMQClient, msgBodys []string, queueName string, delaySeconds int) (messageIds []string, err error) {
@@ -195,10 +342,49 @@ func (this *Queue) ReceiveMessage(pollingWaitSeconds int) (Message, error) {
 	if resp.Code != 0 {
 		return resp.Message, &resp.CommResp
 	}
-	return resp.Message, nil
+	deliver, err := this.prepare(&resp.Message)
+	if !deliver {
+		return Message{}, &CommResp{Code: codeNoMessage, Message: "no message"}
+	}
+	return resp.Message, err
 }
 
+// BatchReceiveMessage 批量接收消息。部分消息解码失败时返回正常解码的消息和 *BatchDecodeError，
+// 失败的消息只在 BatchDecodeError 中
 func (this *Queue) BatchReceiveMessage(numOfMsg, pollingWaitSeconds int) ([]Message, error) {
+	msgs, err := this.batchReceiveMessage(context.Background(), numOfMsg, pollingWaitSeconds)
+	if err != nil {
+		return nil, err
+	}
+	var failed *BatchDecodeError
+	delivered := msgs[:0]
+	for i := range msgs {
+		deliver, err := this.prepare(&msgs[i])
+		if !deliver {
+			continue
+		}
+		if err != nil {
+			if failed == nil {
+				failed = &BatchDecodeError{}
+			}
+			failed.Failures = append(failed.Failures, DecodeFailure{Queue: this, Message: msgs[i], Err: err})
+			continue
+		}
+		delivered = append(delivered, msgs[i])
+	}
+	if failed != nil {
+		if len(delivered) == 0 {
+			return nil, failed
+		}
+		return delivered, failed
+	}
+	if len(delivered) == 0 {
+		return nil, &CommResp{Code: codeNoMessage, Message: "no message"}
+	}
+	return delivered, nil
+}
+
+func (this *Queue) batchReceiveMessage(ctx context.Context, numOfMsg, pollingWaitSeconds int) ([]Message, error) {
 	param := make(map[string]string)
 	param["queueName"] = this.queueName
 	param["numOfMsg"] = strconv.Itoa(numOfMsg)
@@ -214,7 +400,7 @@ func (this *Queue) BatchReceiveMessage(numOfMsg, pollingWaitSeconds int) ([]Mess
 		Msgs []Message `json:"msgInfoList"`
 	}
 
-	if err := this.client.call("BatchReceiveMessage", param, &resp); err != nil {
+	if err := this.client.callContext(ctx, "BatchReceiveMessage", param, &resp); err != nil {
 		return nil, err
 	}
 
@@ -224,15 +410,33 @@ func (this *Queue) BatchReceiveMessage(numOfMsg, pollingWaitSeconds int) ([]Mess
 	return resp.Msgs, nil
 }
 
+// prepare 解码接收到的消息，返回false表示消息已在内部处理(如转发未到投递时间的定时消息)，不交给调用方
+func (this *Queue) prepare(msg *Message) (bool, error) {
+	if this.forwardScheduled(msg) {
+		return false, nil
+	}
+	return true, this.codec.decode(msg)
+}
+
 func (this *Queue) DeleteMessage(receiptHandle string) (err error) {
 	param := make(map[string]string)
 	param["queueName"] = this.queueName
 	param["receiptHandle"] = receiptHandle
 
-	return this.client.callWithoutResult("DeleteMessage", param)
+	if err = this.client.callWithoutResult("DeleteMessage", param); err != nil {
+		return
+	}
+	this.codec.release(receiptHandle)
+	return
 }
 
 func (this *Queue) BatchDeleteMessage(receiptHandles []string) (err error) {
+	_, err = this.batchDeleteMessage(context.Background(), receiptHandles)
+	return
+}
+
+// batchDeleteMessage 返回删除失败的句柄，服务端没有返回失败明细时视为全部失败
+func (this *Queue) batchDeleteMessage(ctx context.Context, receiptHandles []string) (failed []string, err error) {
 	if len(receiptHandles) == 0 {
 		return
 	}
@@ -242,7 +446,39 @@ func (this *Queue) BatchDeleteMessage(receiptHandles []string) (err error) {
 		param["receiptHandle."+strconv.Itoa(i+1)] = receiptHandle
 	}
 
-	return this.client.callWithoutResult("BatchDeleteMessage", param)
+	var resp struct {
+		CommResp
+		ErrorList []struct {
+			Code          int    `json:"code"`
+			Message       string `json:"message"`
+			ReceiptHandle string `json:"receiptHandle"`
+		} `json:"errorList"`
+	}
+
+	if err = this.client.callContext(ctx, "BatchDeleteMessage", param, &resp); err != nil {
+		return receiptHandles, err
+	}
+
+	if resp.Code != 0 {
+		if len(resp.ErrorList) == 0 {
+			return receiptHandles, &resp.CommResp
+		}
+		failedSet := make(map[string]bool, len(resp.ErrorList))
+		for _, e := range resp.ErrorList {
+			failedSet[e.ReceiptHandle] = true
+			failed = append(failed, e.ReceiptHandle)
+		}
+		deleted := make([]string, 0, len(receiptHandles))
+		for _, h := range receiptHandles {
+			if !failedSet[h] {
+				deleted = append(deleted, h)
+			}
+		}
+		this.codec.release(deleted...)
+		return failed, &resp.CommResp
+	}
+	this.codec.release(receiptHandles...)
+	return nil, nil
 }
 
 func (this *Queue) RewindQueue(backTrackingTime int) (err error) {
@@ -0,0 +1,70 @@
+package cmq_go
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+// HeaderAttempt 消息因处理失败被重新入队的次数
+const HeaderAttempt = "attempt"
+
+// RetryPolicy 处理失败时以指数增长的延时重新发送消息并删除原消息，重试间隔与队列的可见性超时无关
+type RetryPolicy struct {
+	/** 第一次重试的延时，默认1秒 */
+	InitialDelay time.Duration
+	/** 重试延时的上限，默认及最大为 MaxDelaySeconds */
+	MaxDelay time.Duration
+	/** 每次重试延时的倍数，默认2 */
+	Multiplier float64
+	/** 最多重新入队的次数，达到后不再重新入队，交由死信或可见性超时处理，<=0时不限制 */
+	MaxAttempts int
+}
+
+// Delay 第attempt次(从1开始)重试的延时
+func (this RetryPolicy) Delay(attempt int) time.Duration {
+	delay := this.InitialDelay
+	if delay <= 0 {
+		delay = time.Second
+	}
+	multiplier := this.Multiplier
+	if multiplier < 1 {
+		multiplier = 2
+	}
+	limit := time.Duration(MaxDelaySeconds) * time.Second
+	if this.MaxDelay > 0 && this.MaxDelay < limit {
+		limit = this.MaxDelay
+	}
+	for i := 1; i < attempt && delay < limit; i++ {
+		delay = time.Duration(float64(delay) * multiplier)
+	}
+	if delay > limit {
+		delay = limit
+	}
+	return delay
+}
+
+// attempts 消息已重新入队的次数
+func attempts(msg Message) int {
+	n, _ := strconv.Atoi(msg.Headers[HeaderAttempt])
+	return n
+}
+
+// deliveries 消息累计的投递次数，包括重新入队前的投递
+func deliveries(msg Message) int {
+	return msg.DequeueCount + attempts(msg)
+}
+
+// requeue 以重试延时重新发送消息，不经过生产端去重
+func (this *Consumer) requeue(msg Message) error {
+	attempt := attempts(msg) + 1
+	headers := make(map[string]string, len(msg.Headers)+1)
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	delete(headers, HeaderDeliverAt)
+	delete(headers, HeaderDeliveryHops)
+	headers[HeaderAttempt] = strconv.Itoa(attempt)
+	_, err := this.queue.deliver(context.Background(), msg.MsgBody, headers, delaySeconds(this.Retry.Delay(attempt)))
+	return err
+}
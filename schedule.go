@@ -0,0 +1,73 @@
+package cmq_go
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+// MaxDelaySeconds 服务端单次延时投递的上限，超过时消息会分多次转发
+var MaxDelaySeconds = 3600
+
+// 定时消息的目标投递时间(毫秒)与已转发次数
+const (
+	HeaderDeliverAt     = "deliver-at"
+	HeaderDeliveryHops  = "delivery-hops"
+	scheduleGracePeriod = time.Second
+)
+
+// SendMessageAt 在指定时间投递消息，超过服务端延时上限时由接收方在到期前透明地重新入队，
+// 中间的转发对 ReceiveMessage/BatchReceiveMessage 的调用方不可见，因此接收方也需要使用本SDK
+func (this *Queue) SendMessageAt(ctx context.Context, msgBody string, at time.Time) (string, error) {
+	return this.sendMessageAt(ctx, msgBody, nil, at)
+}
+
+func (this *Queue) sendMessageAt(ctx context.Context, msgBody string, headers map[string]string, at time.Time) (string, error) {
+	remaining := time.Until(at)
+	if remaining <= time.Duration(MaxDelaySeconds)*time.Second {
+		return this.sendMessage(ctx, msgBody, headers, delaySeconds(remaining))
+	}
+	h := make(map[string]string, len(headers)+1)
+	for k, v := range headers {
+		h[k] = v
+	}
+	h[HeaderDeliverAt] = strconv.FormatInt(at.UnixNano()/int64(time.Millisecond), 10)
+	return this.sendMessage(ctx, msgBody, h, MaxDelaySeconds)
+}
+
+func delaySeconds(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	seconds := int((d + time.Second - 1) / time.Second)
+	if seconds > MaxDelaySeconds {
+		seconds = MaxDelaySeconds
+	}
+	return seconds
+}
+
+// forwardScheduled 消息未到投递时间时重新入队并删除当前消息，返回true表示消息已转发。
+// 只改写信封中的消息头，消息体(可能已压缩、加密或存入BlobStore)原样转发；
+// 转发失败时同样返回true，消息在可见性超时后会重新被处理
+func (this *Queue) forwardScheduled(msg *Message) bool {
+	body, headers, ok := decodeEnvelope(msg.MsgBody)
+	if !ok {
+		return false
+	}
+	at, err := strconv.ParseInt(headers[HeaderDeliverAt], 10, 64)
+	if err != nil {
+		return false
+	}
+	remaining := time.Until(time.Unix(0, at*int64(time.Millisecond)))
+	if remaining < scheduleGracePeriod {
+		return false
+	}
+
+	hops, _ := strconv.Atoi(headers[HeaderDeliveryHops])
+	headers[HeaderDeliveryHops] = strconv.Itoa(hops + 1)
+	if _, err = _sendMessage(context.Background(), this.client, encodeEnvelope(body, headers), this.queueName, delaySeconds(remaining)); err != nil {
+		return true
+	}
+	this.DeleteMessage(msg.ReceiptHandle)
+	return true
+}
@@ -0,0 +1,95 @@
+package cmq_go
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// MessageTooLargeError 消息体超过队列的 MaxMsgSize，在本地被拒绝，没有发送到服务端
+type MessageTooLargeError struct {
+	QueueName  string
+	Size       int
+	MaxMsgSize int
+}
+
+func (this *MessageTooLargeError) Error() string {
+	return fmt.Sprintf("queue %s: message size %d exceeds maxMsgSize %d", this.QueueName, this.Size, this.MaxMsgSize)
+}
+
+// sizeCheckRetry 获取队列属性失败后再次获取前的等待时间
+const sizeCheckRetry = 5 * time.Second
+
+// sizeCheck 缓存队列的 MaxMsgSize，过期后在下一次发送时重新获取
+type sizeCheck struct {
+	ttl time.Duration
+
+	mu         sync.Mutex
+	maxMsgSize int
+	expires    time.Time
+	fetching   bool
+}
+
+// maxMsgSize 返回缓存的 MaxMsgSize，过期时由一个发送方重新获取，其他发送方继续使用旧值，不等待网络请求
+func (this *Queue) maxMsgSize() int {
+	c := this.sizeCheck
+	c.mu.Lock()
+	if c.fetching || time.Now().Before(c.expires) {
+		max := c.maxMsgSize
+		c.mu.Unlock()
+		return max
+	}
+	c.fetching = true
+	c.mu.Unlock()
+
+	meta, err := this.GetQueueAttributes()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fetching = false
+	if err != nil {
+		// 获取失败时不做本地校验，交给服务端判断；短时间内不再获取，以免服务不可用时每次发送都多一次请求
+		retry := sizeCheckRetry
+		if c.ttl < retry {
+			retry = c.ttl
+		}
+		c.expires = time.Now().Add(retry)
+		return c.maxMsgSize
+	}
+	c.maxMsgSize = meta.MaxMsgSize
+	c.expires = time.Now().Add(c.ttl)
+	return c.maxMsgSize
+}
+
+func (this *Queue) checkSize(msgBody string) error {
+	if this.sizeCheck == nil {
+		return nil
+	}
+	if max := this.maxMsgSize(); max > 0 && len(msgBody) > max {
+		return &MessageTooLargeError{QueueName: this.queueName, Size: len(msgBody), MaxMsgSize: max}
+	}
+	return nil
+}
+
+// checkBatchSize 批量发送时按URL编码后的长度计算总大小
+func (this *Queue) checkBatchSize(msgBodys []string) error {
+	if this.sizeCheck == nil {
+		return nil
+	}
+	max := this.maxMsgSize()
+	if max <= 0 {
+		return nil
+	}
+	total := 0
+	for _, msgBody := range msgBodys {
+		if len(msgBody) > max {
+			return &MessageTooLargeError{QueueName: this.queueName, Size: len(msgBody), MaxMsgSize: max}
+		}
+		total += len(url.QueryEscape(msgBody))
+	}
+	if total > max {
+		return &MessageTooLargeError{QueueName: this.queueName, Size: total, MaxMsgSize: max}
+	}
+	return nil
+}
@@ -0,0 +1,388 @@
+package cmq_go
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	spoolKindQueue = "queue"
+	spoolKindTopic = "topic"
+
+	spoolSuffix    = ".spool"
+	spoolPosSuffix = ".pos"
+	// 服务端明确拒绝或没有账号可以转发的消息不再重试，保存在该文件中供人工处理
+	spoolRejected = "rejected.jsonl"
+)
+
+// spoolRecord 暂存的消息，Body 是已经编码(信封、压缩、加密)后的消息体
+type spoolRecord struct {
+	Kind   string   `json:"kind"`
+	Target string   `json:"target"`
+	Body   string   `json:"body"`
+	Delay  int      `json:"delay,omitempty"`
+	Tags   []string `json:"tags,omitempty"`
+	Time   int64    `json:"time"`
+}
+
+// SpoolStats 暂存区统计
+type SpoolStats struct {
+	/** 等待转发的消息数 */
+	Depth int64
+	/** 最早一条等待转发的消息已暂存的时间 */
+	OldestAge time.Duration
+	/** 累计暂存的消息数 */
+	Spooled int64
+	/** 累计转发成功的消息数 */
+	Forwarded int64
+	/** 累计被服务端拒绝或没有账号可以转发的消息数 */
+	Rejected int64
+}
+
+// Spool CMQ不可用时的本地暂存区。消息按顺序追加到目录下的分段文件中，
+// Run 在服务恢复后按写入顺序转发；暂存区非空时新消息也直接写入暂存区，以保证顺序。
+// 转发时使用目标队列/主题 SetSpool 时的账号，目标在本进程中没有注册(如重启后不再使用)时使用 SetAccount 设置的账号，
+// 都没有时消息写入 rejected.jsonl，不阻塞其他消息
+type Spool struct {
+	dir string
+	/** 转发失败后的重试间隔，默认5秒 */
+	Interval time.Duration
+
+	mu      sync.Mutex
+	seq     int64
+	w       *os.File
+	oldest  time.Time
+	clients map[string]*CMQClient
+	client  *CMQClient
+	notify  chan struct{}
+
+	depth     int64
+	spooled   int64
+	forwarded int64
+	rejected  int64
+}
+
+func NewSpool(dir string) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	spool := &Spool{
+		dir:      dir,
+		Interval: 5 * time.Second,
+		clients:  make(map[string]*CMQClient),
+		notify:   make(chan struct{}, 1),
+	}
+	segments, err := spool.segments()
+	if err != nil {
+		return nil, err
+	}
+	for _, seq := range segments {
+		records, pos, err := spool.load(seq)
+		if err != nil {
+			return nil, err
+		}
+		if pending := len(records) - pos; pending > 0 {
+			if spool.depth == 0 {
+				spool.oldest = time.Unix(0, records[pos].Time*int64(time.Millisecond))
+			}
+			spool.depth += int64(pending)
+		}
+		spool.seq = seq
+	}
+	// 每次启动写入新的分段，已有分段只读
+	spool.seq++
+	return spool, nil
+}
+
+func (this *Spool) Stats() SpoolStats {
+	this.mu.Lock()
+	oldest := this.oldest
+	this.mu.Unlock()
+	stats := SpoolStats{
+		Depth:     atomic.LoadInt64(&this.depth),
+		Spooled:   atomic.LoadInt64(&this.spooled),
+		Forwarded: atomic.LoadInt64(&this.forwarded),
+		Rejected:  atomic.LoadInt64(&this.rejected),
+	}
+	if stats.Depth > 0 && !oldest.IsZero() {
+		stats.OldestAge = time.Since(oldest)
+	}
+	return stats
+}
+
+// SetAccount 设置转发未注册目标的消息时使用的账号
+func (this *Spool) SetAccount(account *Account) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.client = account.client
+}
+
+func (this *Spool) register(kind, target string, client *CMQClient) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.clients[kind+"/"+target] = client
+}
+
+func (this *Spool) pending() bool {
+	return atomic.LoadInt64(&this.depth) > 0
+}
+
+func (this *Spool) append(records ...spoolRecord) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.w == nil {
+		w, err := os.OpenFile(this.segmentPath(this.seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		this.w = w
+	}
+	var buf []byte
+	for _, r := range records {
+		line, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	if _, err := this.w.Write(buf); err != nil {
+		return err
+	}
+	if err := this.w.Sync(); err != nil {
+		return err
+	}
+	if atomic.LoadInt64(&this.depth) == 0 {
+		this.oldest = time.Unix(0, records[0].Time*int64(time.Millisecond))
+	}
+	atomic.AddInt64(&this.depth, int64(len(records)))
+	atomic.AddInt64(&this.spooled, int64(len(records)))
+	select {
+	case this.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Run 在后台转发暂存的消息直到ctx取消
+func (this *Spool) Run(ctx context.Context) error {
+	for {
+		err := this.Forward(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(this.Interval):
+			}
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-this.notify:
+		}
+	}
+}
+
+// Forward 按顺序转发所有暂存的消息，遇到可重试的错误时停止并返回该错误
+func (this *Spool) Forward(ctx context.Context) error {
+	this.mu.Lock()
+	if this.w != nil {
+		// 切换到新的分段，当前分段变为只读后转发
+		this.w.Close()
+		this.w = nil
+		this.seq++
+	}
+	this.mu.Unlock()
+
+	segments, err := this.segments()
+	if err != nil {
+		return err
+	}
+	for _, seq := range segments {
+		this.mu.Lock()
+		current := seq >= this.seq
+		this.mu.Unlock()
+		if current {
+			break
+		}
+		if err = this.forwardSegment(ctx, seq); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (this *Spool) forwardSegment(ctx context.Context, seq int64) error {
+	records, pos, err := this.load(seq)
+	if err != nil {
+		return err
+	}
+	if pos < len(records) {
+		this.mu.Lock()
+		this.oldest = time.Unix(0, records[pos].Time*int64(time.Millisecond))
+		this.mu.Unlock()
+	}
+	for ; pos < len(records); pos++ {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		r := records[pos]
+		this.mu.Lock()
+		client := this.clients[r.Kind+"/"+r.Target]
+		if client == nil {
+			client = this.client
+		}
+		this.mu.Unlock()
+
+		if client == nil {
+			err = fmt.Errorf("spool: %s %s is not registered", r.Kind, r.Target)
+		} else {
+			err = r.send(ctx, client)
+		}
+		if err != nil {
+			if isTransient(ctx, err) {
+				return err
+			}
+			if err = this.reject(r, err); err != nil {
+				return err
+			}
+			atomic.AddInt64(&this.rejected, 1)
+		} else {
+			atomic.AddInt64(&this.forwarded, 1)
+		}
+		if err = ioutil.WriteFile(this.segmentPath(seq)+spoolPosSuffix, []byte(strconv.Itoa(pos+1)), 0644); err != nil {
+			return err
+		}
+		atomic.AddInt64(&this.depth, -1)
+		this.mu.Lock()
+		if pos+1 < len(records) {
+			this.oldest = time.Unix(0, records[pos+1].Time*int64(time.Millisecond))
+		} else if !this.pending() {
+			this.oldest = time.Time{}
+		}
+		this.mu.Unlock()
+	}
+	os.Remove(this.segmentPath(seq) + spoolPosSuffix)
+	return os.Remove(this.segmentPath(seq))
+}
+
+func (this spoolRecord) send(ctx context.Context, client *CMQClient) error {
+	var err error
+	switch this.Kind {
+	case spoolKindQueue:
+		elapsed := time.Since(time.Unix(0, this.Time*int64(time.Millisecond)))
+		_, err = _sendMessage(ctx, client, this.Body, this.Target, delaySeconds(time.Duration(this.Delay)*time.Second-elapsed))
+	case spoolKindTopic:
+		_, err = _publishMessage(client, this.Target, this.Body, this.Tags, "")
+	default:
+		err = fmt.Errorf("spool: unknown kind %q", this.Kind)
+	}
+	return err
+}
+
+func (this *Spool) reject(r spoolRecord, cause error) error {
+	line, err := json.Marshal(struct {
+		spoolRecord
+		Error string `json:"error"`
+	}{r, cause.Error()})
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(this.dir, spoolRejected), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+func (this *Spool) segmentPath(seq int64) string {
+	return filepath.Join(this.dir, fmt.Sprintf("%020d%s", seq, spoolSuffix))
+}
+
+func (this *Spool) segments() ([]int64, error) {
+	entries, err := ioutil.ReadDir(this.dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []int64
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), spoolSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseInt(strings.TrimSuffix(e.Name(), spoolSuffix), 10, 64)
+		if err == nil {
+			segments = append(segments, seq)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+// load 读取分段中的消息和已转发的位置，进程崩溃时写了一半的最后一行会被忽略
+func (this *Spool) load(seq int64) (records []spoolRecord, pos int, err error) {
+	f, err := os.Open(this.segmentPath(seq))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var r spoolRecord
+		if json.Unmarshal(scanner.Bytes(), &r) == nil {
+			records = append(records, r)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+	if data, e := ioutil.ReadFile(this.segmentPath(seq) + spoolPosSuffix); e == nil {
+		pos, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+	}
+	if pos > len(records) {
+		pos = len(records)
+	}
+	return records, pos, nil
+}
+
+// isTransient 网络错误、HTTP 5xx/429 可以稍后重试，服务端返回的业务错误不重试
+func isTransient(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	switch e := err.(type) {
+	case *HTTPError:
+		return e.StatusCode >= 500 || e.StatusCode == 429
+	case net.Error:
+		return true
+	}
+	return false
+}
+
+func newSpoolRecord(kind, target, body string, delaySeconds int, tags []string) spoolRecord {
+	return spoolRecord{
+		Kind:   kind,
+		Target: target,
+		Body:   body,
+		Delay:  delaySeconds,
+		Tags:   tags,
+		Time:   time.Now().UnixNano() / int64(time.Millisecond),
+	}
+}
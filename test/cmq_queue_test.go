@@ -163,3 +163,34 @@ func Test_BatchSendReceiveDeleteMessage(t *testing.T) {
 	}
 	t.Logf("BatchDeleteMessage msgId: %v", msgIds)
 }
+
+// 发送，接收带消息头的信封消息
+func Test_SendReceiveEnvelopeMessage(t *testing.T) {
+	account := cmq_go.NewAccount(endpointQueue, secretId, secretKey)
+	queue := account.GetQueue("queue-test-001")
+	// send
+	headers := map[string]string{
+		cmq_go.HeaderContentType:   "application/json",
+		cmq_go.HeaderCorrelationID: "test-001",
+	}
+	msgId, err := queue.SendMessageWithHeaders(`{"hello":"world"}`, headers)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	t.Logf("SendMessageWithHeaders msgId: %v", msgId)
+	// receive
+	msg, err := queue.ReceiveMessage(10)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if msg.MsgBody != `{"hello":"world"}` || msg.Headers[cmq_go.HeaderCorrelationID] != "test-001" {
+		t.Errorf("unexpected message: %v %v", msg.MsgBody, msg.Headers)
+	}
+	// delete
+	if err = queue.DeleteMessage(msg.ReceiptHandle); err != nil {
+		t.Error(err)
+		return
+	}
+}
@@ -0,0 +1,101 @@
+package offline
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	cmq_go "github.com/glutwins/cmq-go"
+)
+
+// fill 向队列写入n条消息，使 activeMsgNum 达到n
+func fill(t *testing.T, queue *cmq_go.Queue, n int) {
+	for i := 0; i < n; i++ {
+		if _, err := queue.SendMessage("x"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// 超过 SlowWatermark 后发送前等待 SlowDelay
+func Test_BackpressureSlow(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+	server.setMaxMsgHeapNum(10)
+
+	queue := cmq_go.NewAccount(server.URL, secretId, secretKey).GetQueue("queue-test-001")
+	fill(t, queue, 8)
+	queue.SetBackpressure(&cmq_go.Backpressure{SlowDelay: 50 * time.Millisecond})
+
+	start := time.Now()
+	if _, err := queue.SendMessage("a"); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("send not slowed: %v", elapsed)
+	}
+	if stats := queue.BackpressureStats(); stats.Slowed != 1 || stats.Depth != 8 || stats.MaxMsgHeapNum != 10 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+// 超过 HighWatermark 且不阻塞时直接拒绝
+func Test_BackpressureReject(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+	server.setMaxMsgHeapNum(10)
+
+	queue := cmq_go.NewAccount(server.URL, secretId, secretKey).GetQueue("queue-test-001")
+	fill(t, queue, 10)
+	queue.SetBackpressure(&cmq_go.Backpressure{})
+
+	var full *cmq_go.QueueFullError
+	if _, err := queue.SendMessage("a"); !errors.As(err, &full) || full.Depth != 10 || full.MaxMsgHeapNum != 10 {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := queue.BatchSendMessage([]string{"a", "b"}); !errors.As(err, &full) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := len(server.bodies("queue-test-001")); n != 10 {
+		t.Errorf("rejected messages were sent: %d", n)
+	}
+	if stats := queue.BackpressureStats(); stats.Rejected != 2 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+// Block 时等待队列低于 HighWatermark，超过 MaxBlock 后返回 QueueFullError
+func Test_BackpressureBlock(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+	server.setMaxMsgHeapNum(10)
+
+	queue := cmq_go.NewAccount(server.URL, secretId, secretKey).GetQueue("queue-test-001")
+	fill(t, queue, 10)
+	queue.SetBackpressure(&cmq_go.Backpressure{Block: true, Interval: 20 * time.Millisecond, MaxBlock: 100 * time.Millisecond})
+
+	start := time.Now()
+	var full *cmq_go.QueueFullError
+	if _, err := queue.SendMessage("a"); !errors.As(err, &full) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("returned before MaxBlock: %v", elapsed)
+	}
+
+	// 消费掉一半消息后阻塞的发送继续
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		msgs, _ := queue.BatchReceiveMessage(5, 1)
+		for _, msg := range msgs {
+			queue.DeleteMessage(msg.ReceiptHandle)
+		}
+	}()
+	queue.SetBackpressure(&cmq_go.Backpressure{Block: true, Interval: 20 * time.Millisecond, MaxBlock: 5 * time.Second})
+	if _, err := queue.SendMessage("a"); err != nil {
+		t.Fatal(err)
+	}
+	if stats := queue.BackpressureStats(); stats.Blocked != 1 || stats.Rejected != 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
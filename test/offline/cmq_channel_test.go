@@ -0,0 +1,103 @@
+package offline
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	cmq_go "github.com/glutwins/cmq-go"
+)
+
+// Messages 收到的消息 Ack 后删除，ctx取消后关闭通道
+func Test_QueueMessages(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+
+	queue := cmq_go.NewAccount(server.URL, secretId, secretKey).GetQueue("queue-test-001")
+	queue.BatchSendMessage([]string{"a", "b", "c"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := queue.Messages(ctx, cmq_go.ReceiveOptions{PollingWaitSeconds: -1})
+	for i := 0; i < 3; i++ {
+		select {
+		case d := <-ch:
+			if err := d.Ack(); err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("message not received")
+		}
+	}
+	cancel()
+	for range ch {
+	}
+	if bodies := server.bodies("queue-test-001"); len(bodies) != 0 {
+		t.Errorf("messages not acked: %v", bodies)
+	}
+}
+
+// Nack 重新发送消息并删除原消息，使用信封时 attempt 加1，否则原样发送
+func Test_DeliveryNack(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+
+	account := cmq_go.NewAccount(server.URL, secretId, secretKey)
+	for _, envelope := range []bool{false, true} {
+		queueName := fmt.Sprintf("queue-test-%v", envelope)
+		queue := account.GetQueue(queueName)
+		queue.SetEnvelope(envelope)
+		queue.SendMessage("a")
+
+		ctx, cancel := context.WithCancel(context.Background())
+		ch := queue.Messages(ctx, cmq_go.ReceiveOptions{PollingWaitSeconds: -1})
+		d := <-ch
+		// 等接收协程退出后再 Nack，以免重新发送的消息被仍在进行的接收取走
+		cancel()
+		for range ch {
+		}
+		if err := d.Nack(); err != nil {
+			t.Fatal(err)
+		}
+		bodies := server.bodies(queueName)
+		if len(bodies) != 1 {
+			t.Fatalf("envelope %v: unexpected messages: %v", envelope, bodies)
+		}
+		if !envelope && bodies[0] != "a" {
+			t.Errorf("plain message rewritten: %q", bodies[0])
+		}
+		msgs, err := queue.BatchReceiveMessage(16, 0)
+		if err != nil || msgs[0].MsgBody != "a" {
+			t.Fatalf("receive: %v %v", msgs, err)
+		}
+		if want := map[bool]string{false: "", true: "1"}[envelope]; msgs[0].Headers[cmq_go.HeaderAttempt] != want {
+			t.Errorf("envelope %v: attempt %q, want %q", envelope, msgs[0].Headers[cmq_go.HeaderAttempt], want)
+		}
+	}
+}
+
+// Sink 写入的消息被批量发送，关闭通道后发送剩余的消息
+func Test_QueueSink(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+
+	queue := cmq_go.NewAccount(server.URL, secretId, secretKey).GetQueue("queue-test-001")
+	ch := queue.Sink(context.Background())
+	for i := 0; i < 20; i++ {
+		ch <- fmt.Sprint(i)
+	}
+	close(ch)
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if len(server.bodies("queue-test-001")) == 20 {
+			break
+		}
+	}
+	bodies := server.bodies("queue-test-001")
+	if len(bodies) != 20 || bodies[0] != "0" || bodies[19] != "19" {
+		t.Errorf("unexpected messages: %v", bodies)
+	}
+	if n := server.count("BatchSendMessage"); n != 2 {
+		t.Errorf("BatchSendMessage called %d times, want 2", n)
+	}
+}
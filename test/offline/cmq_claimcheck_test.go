@@ -0,0 +1,115 @@
+package offline
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	cmq_go "github.com/glutwins/cmq-go"
+)
+
+func newBlobStore(t *testing.T) (*cmq_go.FileBlobStore, string) {
+	dir := t.TempDir()
+	store, err := cmq_go.NewFileBlobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, dir
+}
+
+func blobCount(t *testing.T, dir string) int {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+// 超过阈值的消息体存入 BlobStore，接收时取回，DeleteMessage/BatchDeleteMessage 成功后清理
+func Test_ClaimCheck(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+	store, dir := newBlobStore(t)
+
+	queue := cmq_go.NewAccount(server.URL, secretId, secretKey).GetQueue("queue-test-001")
+	queue.SetClaimCheck(store, 100)
+	large := strings.Repeat("x", 101)
+	queue.SendMessage(strings.Repeat("y", 100))
+	queue.BatchSendMessage([]string{large, large + "1"})
+	queue.SendMessage(large + "2")
+
+	raw := server.bodies("queue-test-001")
+	if strings.Contains(raw[0], "claim-check=") {
+		t.Errorf("message below threshold stored: %q", raw[0])
+	}
+	for _, body := range raw[1:] {
+		if !strings.Contains(body, "claim-check=") || strings.Contains(body, large) {
+			t.Errorf("message above threshold not stored: %q", body)
+		}
+	}
+	if n := blobCount(t, dir); n != 3 {
+		t.Fatalf("blobs: %d", n)
+	}
+
+	msgs, err := queue.BatchReceiveMessage(16, 0)
+	if err != nil || len(msgs) != 4 {
+		t.Fatalf("receive: %v %v", msgs, err)
+	}
+	for i, want := range []string{strings.Repeat("y", 100), large, large + "1", large + "2"} {
+		if msgs[i].MsgBody != want || len(msgs[i].Headers) != 0 {
+			t.Errorf("message %d: %d bytes, headers %v", i, len(msgs[i].MsgBody), msgs[i].Headers)
+		}
+	}
+	if err = queue.DeleteMessage(msgs[3].ReceiptHandle); err != nil {
+		t.Fatal(err)
+	}
+	if n := blobCount(t, dir); n != 2 {
+		t.Errorf("blob not released after DeleteMessage: %d", n)
+	}
+	if err = queue.BatchDeleteMessage([]string{msgs[0].ReceiptHandle, msgs[1].ReceiptHandle, msgs[2].ReceiptHandle}); err != nil {
+		t.Fatal(err)
+	}
+	if n := blobCount(t, dir); n != 0 {
+		t.Errorf("blobs not released after BatchDeleteMessage: %d", n)
+	}
+}
+
+// 主题消息的数据删除消息后保留，由 Purge 按时间清理
+func Test_ClaimCheckTopicPurge(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+	store, dir := newBlobStore(t)
+
+	account := cmq_go.NewAccount(server.URL, secretId, secretKey)
+	topic := account.GetTopic("topic-test-001")
+	topic.SetClaimCheck(store, 10)
+	if _, err := topic.BatchPublishMessage([]string{strings.Repeat("x", 11)}); err != nil {
+		t.Fatal(err)
+	}
+	// 未配置编码的队列原样发送，模拟主题投递到订阅的队列
+	account.GetQueue("queue-test-001").SendMessage(server.published("topic-test-001")[0])
+
+	queue := account.GetQueue("queue-test-001")
+	queue.SetClaimCheck(store, 10)
+	msgs, err := queue.BatchReceiveMessage(1, 0)
+	if err != nil || msgs[0].MsgBody != strings.Repeat("x", 11) {
+		t.Fatalf("receive: %v %v", msgs, err)
+	}
+	queue.DeleteMessage(msgs[0].ReceiptHandle)
+	if n := blobCount(t, dir); n != 1 {
+		t.Fatalf("shared blob released: %d", n)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(filepath.Join(dir, entries[0].Name()), old, old)
+	store.Put([]byte("fresh"))
+	if n, err := store.Purge(time.Hour); err != nil || n != 1 {
+		t.Errorf("Purge: %d %v", n, err)
+	}
+	if n := blobCount(t, dir); n != 1 {
+		t.Errorf("fresh blob purged: %d", n)
+	}
+}
@@ -0,0 +1,96 @@
+package offline
+
+import (
+	"compress/gzip"
+	"errors"
+	"math/rand"
+	"strings"
+	"testing"
+
+	cmq_go "github.com/glutwins/cmq-go"
+)
+
+// 低于阈值的消息原样发送，超过阈值的消息压缩后发送，接收时解压
+func Test_Compression(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+
+	queue := cmq_go.NewAccount(server.URL, secretId, secretKey).GetQueue("queue-test-001")
+	queue.SetCompression(cmq_go.GzipCompressor{Level: gzip.DefaultCompression}, 100)
+	small := strings.Repeat("a", 99)
+	large := strings.Repeat("hello world ", 100)
+	queue.SendMessage(small)
+	queue.BatchSendMessage([]string{large, large})
+
+	raw := server.bodies("queue-test-001")
+	if raw[0] != small {
+		t.Errorf("message below threshold changed: %q", raw[0])
+	}
+	for _, body := range raw[1:] {
+		if !strings.Contains(body, "content-encoding=gzip") || len(body) >= len(large) {
+			t.Errorf("message above threshold not compressed: %d bytes", len(body))
+		}
+	}
+
+	msgs, err := queue.BatchReceiveMessage(16, 0)
+	if err != nil || len(msgs) != 3 {
+		t.Fatalf("receive: %v %v", msgs, err)
+	}
+	if msgs[0].MsgBody != small || msgs[0].Headers != nil {
+		t.Errorf("unexpected message: %+v", msgs[0])
+	}
+	for _, msg := range msgs[1:] {
+		if msg.MsgBody != large || len(msg.Headers) != 0 {
+			t.Errorf("not decompressed: %d bytes, headers %v", len(msg.MsgBody), msg.Headers)
+		}
+	}
+
+	stats := queue.CompressionStats()
+	if stats.Compressed != 2 || stats.Skipped != 0 || stats.RawBytes != int64(2*len(large)) {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	if ratio := stats.Ratio(); ratio <= 0 || ratio >= 1 || ratio != float64(stats.EncodedBytes)/float64(stats.RawBytes) {
+		t.Errorf("unexpected ratio: %v", ratio)
+	}
+	if ratio := (cmq_go.CompressionStats{}).Ratio(); ratio != 1 {
+		t.Errorf("empty stats ratio: %v", ratio)
+	}
+}
+
+// 压缩后没有变小的消息原样发送，计入 Skipped
+func Test_CompressionSkipped(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+
+	queue := cmq_go.NewAccount(server.URL, secretId, secretKey).GetQueue("queue-test-001")
+	queue.SetCompression(cmq_go.GzipCompressor{Level: gzip.DefaultCompression}, 100)
+	data := make([]byte, 2000)
+	rand.New(rand.NewSource(1)).Read(data)
+	queue.SendMessage(string(data))
+
+	if raw := server.bodies("queue-test-001"); raw[0] != string(data) {
+		t.Error("incompressible message changed")
+	}
+	if stats := queue.CompressionStats(); stats.Compressed != 0 || stats.Skipped != 1 || stats.RawBytes != 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+// 未注册的 content-encoding 解码失败，消息体保持原样
+func Test_CompressionUnknownEncoding(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+
+	queue := cmq_go.NewAccount(server.URL, secretId, secretKey).GetQueue("queue-test-001")
+	raw := "~cmq/1 content-encoding=zz\nabc"
+	queue.SendMessage(raw)
+
+	msgs, err := queue.BatchReceiveMessage(16, 0)
+	var failed *cmq_go.BatchDecodeError
+	if len(msgs) != 0 || !errors.As(err, &failed) || len(failed.Failures) != 1 {
+		t.Fatalf("expected decode error: %v %v", msgs, err)
+	}
+	if f := failed.Failures[0]; f.Message.MsgBody != raw || !strings.Contains(f.Err.Error(), `unknown content-encoding "zz"`) {
+		t.Errorf("unexpected failure: %q %v", f.Message.MsgBody, f.Err)
+	}
+}
@@ -0,0 +1,275 @@
+package offline
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	cmq_go "github.com/glutwins/cmq-go"
+)
+
+// 处理成功的消息被删除，处理失败的消息保留在队列中
+func Test_ConsumerRun(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+
+	queue := cmq_go.NewAccount(server.URL, secretId, secretKey).GetQueue("queue-test-001")
+	queue.BatchSendMessage([]string{"a", "b", "fail", "c"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var mu sync.Mutex
+	handled := 0
+	consumer := cmq_go.NewConsumer(queue, func(ctx context.Context, msg cmq_go.Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if handled++; handled == 4 {
+			cancel()
+		}
+		if msg.MsgBody == "fail" {
+			return errors.New("fail")
+		}
+		return nil
+	})
+	consumer.Concurrency = 2
+	consumer.PollingWaitSeconds = 0
+
+	done := make(chan error)
+	go func() { done <- consumer.Run(ctx) }()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("consumer did not stop")
+	}
+	if bodies := server.bodies("queue-test-001"); len(bodies) != 1 || bodies[0] != "fail" {
+		t.Errorf("unexpected queue messages: %v", bodies)
+	}
+}
+
+// 通过 Acker 批量删除处理成功的消息，退出前删除剩余句柄
+func Test_ConsumerBatchAck(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+
+	queue := cmq_go.NewAccount(server.URL, secretId, secretKey).GetQueue("queue-test-001")
+	queue.BatchSendMessage([]string{"a", "b", "c"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var mu sync.Mutex
+	handled := 0
+	consumer := cmq_go.NewConsumer(queue, func(ctx context.Context, msg cmq_go.Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if handled++; handled == 3 {
+			cancel()
+		}
+		return nil
+	})
+	consumer.PollingWaitSeconds = 0
+	consumer.Acker = cmq_go.NewAcker(queue)
+	consumer.Acker.Interval = time.Hour
+	consumer.Acker.OnFailure = func(err *cmq_go.AckError) { t.Error(err) }
+
+	consumer.Run(ctx)
+	if bodies := server.bodies("queue-test-001"); len(bodies) != 0 {
+		t.Errorf("messages not acked: %v", bodies)
+	}
+}
+
+// 批量收满且有堆积时 Adaptive 加大每批接收的消息数
+func Test_ConsumerAdaptive(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+
+	queue := cmq_go.NewAccount(server.URL, secretId, secretKey).GetQueue("queue-test-001")
+	for i := 0; i < 20; i++ {
+		queue.BatchSendMessage([]string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k", "l", "m", "n", "o", "p"})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var consumer *cmq_go.Consumer
+	var mu sync.Mutex
+	handled, maxBatchSize := 0, 0
+	consumer = cmq_go.NewConsumer(queue, func(ctx context.Context, msg cmq_go.Message) error {
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		if n := consumer.Stats().BatchSize; n > maxBatchSize {
+			maxBatchSize = n
+		}
+		if handled++; handled == 320 {
+			cancel()
+		}
+		return nil
+	})
+	consumer.Concurrency = 4
+	consumer.BatchSize = 1
+	consumer.PollingWaitSeconds = 0
+	consumer.Adaptive = &cmq_go.Adaptive{Interval: 50 * time.Millisecond}
+
+	done := make(chan error)
+	go func() { done <- consumer.Run(ctx) }()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("consumer did not finish")
+	}
+	if maxBatchSize <= 1 {
+		t.Errorf("batch size did not grow: %d", maxBatchSize)
+	}
+	if stats := consumer.Stats(); stats.HandlerLatency <= 0 {
+		t.Errorf("handler latency not measured: %+v", stats)
+	}
+}
+
+// 停止时预取缓冲中的消息不处理也不删除
+func Test_ConsumerPrefetch(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+
+	queue := cmq_go.NewAccount(server.URL, secretId, secretKey).GetQueue("queue-test-001")
+	queue.BatchSendMessage([]string{"a", "b", "c", "d", "e", "f", "g", "h"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var consumer *cmq_go.Consumer
+	consumer = cmq_go.NewConsumer(queue, func(ctx context.Context, msg cmq_go.Message) error {
+		for consumer.Stats().Buffered < 4 {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+		return nil
+	})
+	consumer.Concurrency = 1
+	consumer.Prefetch = 4
+	consumer.PollingWaitSeconds = 0
+
+	done := make(chan error)
+	go func() { done <- consumer.Run(ctx) }()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("consumer did not stop")
+	}
+	stats := consumer.Stats()
+	if stats.Handled != 1 || stats.Released != 4 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	if bodies := server.bodies("queue-test-001"); len(bodies) != 7 {
+		t.Errorf("buffered messages deleted: %v", bodies)
+	}
+}
+
+// MultiConsumer 把各队列的消息交给对应的处理函数
+func Test_MultiConsumer(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+
+	account := cmq_go.NewAccount(server.URL, secretId, secretKey)
+	queue1 := account.GetQueue("queue-test-001")
+	queue2 := account.GetQueue("queue-test-002")
+	queue1.BatchSendMessage([]string{"1a", "1b", "1c"})
+	queue2.BatchSendMessage([]string{"2a", "2b"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var mu sync.Mutex
+	got := map[string]string{}
+	handler := func(queueName string) cmq_go.Handler {
+		return func(ctx context.Context, msg cmq_go.Message) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if got[msg.MsgBody] = queueName; len(got) == 5 {
+				cancel()
+			}
+			return nil
+		}
+	}
+	consumer := cmq_go.NewMultiConsumer()
+	consumer.Concurrency = 2
+	consumer.BatchSize = 1
+	consumer.RateLimit = 1000
+	consumer.Add(queue1, 2, handler("queue-test-001"))
+	consumer.Add(queue2, 1, handler("queue-test-002"))
+
+	done := make(chan error)
+	go func() { done <- consumer.Run(ctx) }()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("consumer did not finish")
+	}
+	for body, queueName := range got {
+		if queueName[len(queueName)-1] != body[0] {
+			t.Errorf("message %s routed to %s", body, queueName)
+		}
+	}
+	if len(server.bodies("queue-test-001"))+len(server.bodies("queue-test-002")) != 0 {
+		t.Error("messages not deleted")
+	}
+}
+
+// 截止时间早于 Acker 当前等待的时间时，在消息重新可见前删除
+func Test_AckerEarlyDeadline(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+
+	queue := cmq_go.NewAccount(server.URL, secretId, secretKey).GetQueue("queue-test-001")
+	queue.SendMessage("a")
+	msg, err := queue.ReceiveMessage(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.NextVisibleTime = time.Now().Add(time.Second).UnixNano() / int64(time.Millisecond)
+
+	acker := cmq_go.NewAcker(queue)
+	acker.Interval = 3 * time.Second
+	acker.Margin = 500 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go acker.Run(ctx)
+	// 等待 Run 进入按 Interval 计时的等待
+	time.Sleep(50 * time.Millisecond)
+
+	acker.Ack(msg)
+	time.Sleep(time.Second)
+	if bodies := server.bodies("queue-test-001"); len(bodies) != 0 {
+		t.Errorf("message not deleted before visibility timeout: %v", bodies)
+	}
+}
+
+// Run 的ctx在删除进行中被取消时，删除照常完成
+func Test_AckerCancelDuringDelete(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+
+	queue := cmq_go.NewAccount(server.URL, secretId, secretKey).GetQueue("queue-test-001")
+	queue.SendMessage("a")
+	msg, err := queue.ReceiveMessage(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acker := cmq_go.NewAcker(queue)
+	acker.Interval = 10 * time.Millisecond
+	failures := 0
+	acker.OnFailure = func(*cmq_go.AckError) { failures++ }
+	server.setLatency(200 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		acker.Run(ctx)
+		close(done)
+	}()
+	acker.Ack(msg)
+	// 等待删除请求发出后取消
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	<-done
+
+	if bodies := server.bodies("queue-test-001"); len(bodies) != 0 || failures != 0 {
+		t.Errorf("message not deleted: %v, %d failures", bodies, failures)
+	}
+}
@@ -0,0 +1,98 @@
+package offline
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cmq_go "github.com/glutwins/cmq-go"
+)
+
+// runUntil 运行consumer直到done返回true，期间不断使消息可见以模拟重新投递
+func runUntil(t *testing.T, server *fakeCMQ, queueName string, consumer *cmq_go.Consumer, done func() bool) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		defer cancel()
+		for deadline := time.Now().Add(5 * time.Second); !done(); {
+			if time.Now().After(deadline) {
+				t.Error("timeout")
+				return
+			}
+			server.expire(queueName)
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	consumer.Run(ctx)
+}
+
+// 第 MaxDeliveries 次投递处理失败后转入死信，死信携带原始消息ID、原因和投递次数
+func Test_DeadLetterMaxDeliveries(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+
+	account := cmq_go.NewAccount(server.URL, secretId, secretKey)
+	queue := account.GetQueue("queue-test-001")
+	msgId, _ := queue.SendMessage("a")
+
+	var calls int64
+	consumer := cmq_go.NewConsumer(queue, func(ctx context.Context, msg cmq_go.Message) error {
+		atomic.AddInt64(&calls, 1)
+		return errors.New("boom")
+	})
+	consumer.PollingWaitSeconds = 0
+	consumer.MaxDeliveries = 2
+	consumer.DeadLetter = cmq_go.NewQueueDeadLetter(account.GetQueue("queue-test-dlq"))
+	runUntil(t, server, "queue-test-001", consumer, func() bool { return consumer.Stats().DeadLettered == 1 })
+
+	if n := atomic.LoadInt64(&calls); n != 2 {
+		t.Errorf("handler called %d times, want 2", n)
+	}
+	if bodies := server.bodies("queue-test-001"); len(bodies) != 0 {
+		t.Errorf("source message not deleted: %v", bodies)
+	}
+	msgs, err := account.GetQueue("queue-test-dlq").BatchReceiveMessage(16, 0)
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("dead letter: %v %v", msgs, err)
+	}
+	h := msgs[0].Headers
+	if msgs[0].MsgBody != "a" || h[cmq_go.HeaderOriginalMsgId] != msgId || h[cmq_go.HeaderDeadLetterReason] != "boom" ||
+		h[cmq_go.HeaderDeadLetterSource] != "queue-test-001" || h[cmq_go.HeaderDequeueCount] != "2" {
+		t.Errorf("unexpected dead letter: %q %v", msgs[0].MsgBody, h)
+	}
+}
+
+// 投递次数已超过 MaxDeliveries 的消息不交给处理函数，直接转入死信
+func Test_DeadLetterExceeded(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+
+	account := cmq_go.NewAccount(server.URL, secretId, secretKey)
+	queue := account.GetQueue("queue-test-001")
+	queue.SendMessage("a")
+	// 第一次投递没有删除，例如处理中进程退出
+	if _, err := queue.ReceiveMessage(0); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls int64
+	consumer := cmq_go.NewConsumer(queue, func(ctx context.Context, msg cmq_go.Message) error {
+		atomic.AddInt64(&calls, 1)
+		return nil
+	})
+	consumer.PollingWaitSeconds = 0
+	consumer.MaxDeliveries = 1
+	consumer.DeadLetter = cmq_go.NewQueueDeadLetter(account.GetQueue("queue-test-dlq"))
+	runUntil(t, server, "queue-test-001", consumer, func() bool { return consumer.Stats().DeadLettered == 1 })
+
+	if n := atomic.LoadInt64(&calls); n != 0 {
+		t.Errorf("handler called %d times, want 0", n)
+	}
+	msgs, _ := account.GetQueue("queue-test-dlq").BatchReceiveMessage(16, 0)
+	if len(msgs) != 1 || msgs[0].Headers[cmq_go.HeaderDeadLetterReason] != "max deliveries exceeded" ||
+		msgs[0].Headers[cmq_go.HeaderDequeueCount] != strconv.Itoa(2) {
+		t.Errorf("unexpected dead letter: %v", msgs)
+	}
+}
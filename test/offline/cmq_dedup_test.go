@@ -0,0 +1,126 @@
+package offline
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	cmq_go "github.com/glutwins/cmq-go"
+)
+
+// 去重窗口内相同去重键的消息只发送一次，去重键随消息发送
+func Test_SendMessageWithDedupKey(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+
+	queue := cmq_go.NewAccount(server.URL, secretId, secretKey).GetQueue("queue-test-001")
+	queue.SetDedup(cmq_go.NewMemoryDedupStore(100), time.Minute)
+
+	first, err := queue.SendMessageWithDedupKey("hello", "order-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := queue.SendMessageWithDedupKey("hello", "order-1")
+	if err != nil || second != first {
+		t.Fatalf("resend not suppressed: %v %v %v", first, second, err)
+	}
+	queue.SendMessageWithDedupKey("hello", "order-2")
+	if bodies := server.bodies("queue-test-001"); len(bodies) != 2 {
+		t.Fatalf("unexpected queue messages: %v", bodies)
+	}
+
+	msg, err := queue.ReceiveMessage(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.MsgBody != "hello" || msg.Headers[cmq_go.HeaderDedupKey] != "order-1" {
+		t.Errorf("unexpected message: %v %v", msg.MsgBody, msg.Headers)
+	}
+}
+
+// 写入暂存区的消息没有msgId，不记录到去重窗口
+func Test_DedupSpooled(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+
+	spool, err := cmq_go.NewSpool(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue := cmq_go.NewAccount(server.URL, secretId, secretKey).GetQueue("queue-test-001")
+	queue.SetSpool(spool)
+	queue.SetDedup(cmq_go.NewMemoryDedupStore(100), time.Minute)
+
+	server.setDown(true)
+	if msgId, err := queue.SendMessageWithDedupKey("hello", "order-1"); err != nil || msgId != "" {
+		t.Fatalf("spool: %q %v", msgId, err)
+	}
+	server.setDown(false)
+	if err = spool.Forward(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := queue.SendMessageWithDedupKey("hello", "order-1")
+	if err != nil || first == "" {
+		t.Fatalf("spooled send recorded as duplicate: %q %v", first, err)
+	}
+	if second, _ := queue.SendMessageWithDedupKey("hello", "order-1"); second != first {
+		t.Errorf("resend not suppressed: %q %q", first, second)
+	}
+}
+
+// 并发发送相同去重键的消息只发送一次
+func Test_DedupConcurrent(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+	server.setLatency(50 * time.Millisecond)
+
+	queue := cmq_go.NewAccount(server.URL, secretId, secretKey).GetQueue("queue-test-001")
+	queue.SetDedup(cmq_go.NewMemoryDedupStore(100), time.Minute)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := queue.SendMessageWithDedupKey("hello", "order-1"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if bodies := server.bodies("queue-test-001"); len(bodies) != 1 {
+		t.Errorf("unexpected queue messages: %d", len(bodies))
+	}
+}
+
+// 结果未知的发送保留去重键，重试不再发送；确定失败的发送释放去重键
+func Test_DedupFailedSend(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+
+	queue := cmq_go.NewAccount(server.URL, secretId, secretKey).GetQueue("queue-test-001")
+	queue.SetDedup(cmq_go.NewMemoryDedupStore(100), time.Minute)
+
+	server.setDown(true)
+	if _, err := queue.SendMessageWithDedupKey("hello", "order-1"); err == nil {
+		t.Fatal("expected error")
+	}
+	server.setDown(false)
+	if msgId, err := queue.SendMessageWithDedupKey("hello", "order-1"); err != nil || msgId != "" {
+		t.Errorf("retry after uncertain failure: %q %v", msgId, err)
+	}
+	if bodies := server.bodies("queue-test-001"); len(bodies) != 0 {
+		t.Errorf("retry sent: %v", bodies)
+	}
+
+	queue.SetSizeCheck(time.Minute)
+	if _, err := queue.SendMessageWithDedupKey(strings.Repeat("a", 70000), "order-2"); err == nil {
+		t.Fatal("expected error")
+	}
+	if msgId, err := queue.SendMessageWithDedupKey("hello", "order-2"); err != nil || msgId == "" {
+		t.Errorf("retry after definite failure: %q %v", msgId, err)
+	}
+}
@@ -0,0 +1,186 @@
+package offline
+
+import (
+	"compress/gzip"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	cmq_go "github.com/glutwins/cmq-go"
+)
+
+func newKeyRing(t *testing.T, current string, keyIds ...string) *cmq_go.KeyRing {
+	keys := make(map[string][]byte)
+	for i, id := range keyIds {
+		keys[id] = []byte(strings.Repeat(string(rune('a'+i)), 32))
+	}
+	ring, err := cmq_go.NewKeyRing(current, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ring
+}
+
+// receiveOne 接收并删除一条消息，解码失败时返回 BatchDecodeError 中的原始消息和错误
+func receiveOne(t *testing.T, queue *cmq_go.Queue) (cmq_go.Message, error) {
+	msgs, err := queue.BatchReceiveMessage(1, 0)
+	var failed *cmq_go.BatchDecodeError
+	if errors.As(err, &failed) && len(msgs) == 0 && len(failed.Failures) == 1 {
+		msgs, err = []cmq_go.Message{failed.Failures[0].Message}, failed.Failures[0].Err
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("receive: %v %v", msgs, err)
+	}
+	queue.DeleteMessage(msgs[0].ReceiptHandle)
+	return msgs[0], err
+}
+
+// 轮换密钥后旧密钥加密的消息仍可以解密
+func Test_EncryptionRotation(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+
+	ring := newKeyRing(t, "k1", "k1")
+	queue := cmq_go.NewAccount(server.URL, secretId, secretKey).GetQueue("queue-test-001")
+	queue.SetEncryption(ring)
+	queue.SendMessage("m1")
+	ring.AddKey("k2", []byte(strings.Repeat("z", 32)))
+	if err := ring.SetCurrent("k2"); err != nil {
+		t.Fatal(err)
+	}
+	queue.SendMessage("m2")
+
+	raw := server.bodies("queue-test-001")
+	if strings.Contains(raw[0], "m1") || !strings.Contains(raw[0], "encryption-key-id=k1") || !strings.Contains(raw[1], "encryption-key-id=k2") {
+		t.Fatalf("unexpected raw bodies: %v", raw)
+	}
+	for _, want := range []string{"m1", "m2"} {
+		msg, err := receiveOne(t, queue)
+		if err != nil || msg.MsgBody != want {
+			t.Errorf("got %q %v, want %q", msg.MsgBody, err, want)
+		}
+		if _, found := msg.Headers[cmq_go.HeaderEncryptionKeyID]; found {
+			t.Errorf("encryption headers not removed: %v", msg.Headers)
+		}
+	}
+}
+
+// 密钥不存在、密文或密钥ID被篡改时返回 DecryptError，消息体保持密文
+func Test_EncryptionDecryptError(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+
+	account := cmq_go.NewAccount(server.URL, secretId, secretKey)
+	producer := account.GetQueue("queue-test-001")
+	producer.SetEncryption(newKeyRing(t, "k1", "k1", "k2"))
+	producer.SendMessage("secret")
+	sealed := server.bodies("queue-test-001")[0]
+	receiveOne(t, producer)
+
+	i := strings.IndexByte(sealed, '\n') + 1
+	flipped := "A"
+	if sealed[i] == 'A' {
+		flipped = "B"
+	}
+	cases := map[string]struct {
+		raw  string
+		ring *cmq_go.KeyRing
+	}{
+		"unknown key":     {sealed, newKeyRing(t, "k2", "k2")},
+		"tampered body":   {sealed[:i] + flipped + sealed[i+1:], newKeyRing(t, "k1", "k1", "k2")},
+		"tampered key id": {strings.Replace(sealed, "encryption-key-id=k1", "encryption-key-id=k2", 1), newKeyRing(t, "k1", "k1", "k2")},
+	}
+	for name, c := range cases {
+		// 未配置编码的队列原样发送信封
+		account.GetQueue("queue-test-002").SendMessage(c.raw)
+		consumer := account.GetQueue("queue-test-002")
+		consumer.SetEncryption(c.ring)
+		msg, err := receiveOne(t, consumer)
+		var decryptErr *cmq_go.DecryptError
+		if !errors.As(err, &decryptErr) {
+			t.Errorf("%s: expected DecryptError, got %v", name, err)
+		}
+		if msg.MsgBody == "secret" {
+			t.Errorf("%s: message decrypted", name)
+		}
+	}
+}
+
+// 编码顺序为压缩、加密、claim check，解码时相反
+func Test_EncodePipeline(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+
+	dir := t.TempDir()
+	store, err := cmq_go.NewFileBlobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue := cmq_go.NewAccount(server.URL, secretId, secretKey).GetQueue("queue-test-001")
+	queue.SetCompression(cmq_go.GzipCompressor{Level: gzip.DefaultCompression}, 1)
+	queue.SetEncryption(newKeyRing(t, "k1", "k1"))
+	queue.SetClaimCheck(store, 1)
+
+	body := strings.Repeat("hello world ", 100)
+	if _, err = queue.SendMessage(body); err != nil {
+		t.Fatal(err)
+	}
+	raw := server.bodies("queue-test-001")[0]
+	for _, header := range []string{"content-encoding=gzip", "encryption=aes-gcm", "claim-check="} {
+		if !strings.Contains(raw, header) {
+			t.Errorf("header %s missing: %s", header, raw)
+		}
+	}
+	// 存入 BlobStore 的是压缩后加密的数据
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Fatalf("unexpected blobs: %v", entries)
+	}
+	blob, _ := os.ReadFile(filepath.Join(dir, entries[0].Name()))
+	if strings.Contains(string(blob), "hello") || len(blob) >= len(body) {
+		t.Errorf("blob is not compressed and encrypted: %d bytes", len(blob))
+	}
+
+	msg, err := receiveOne(t, queue)
+	if err != nil || msg.MsgBody != body {
+		t.Fatalf("round trip failed: %v", err)
+	}
+	if len(msg.Headers) != 0 {
+		t.Errorf("pipeline headers not removed: %v", msg.Headers)
+	}
+}
+
+// 批量接收时解密失败的消息只在 BatchDecodeError 中，其它消息正常返回
+func Test_EncryptionBatchDecodeError(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+
+	account := cmq_go.NewAccount(server.URL, secretId, secretKey)
+	producer := account.GetQueue("queue-test-001")
+	producer.SendMessage("plain")
+	producer.SetEncryption(newKeyRing(t, "k1", "k1"))
+	badId, _ := producer.SendMessage("secret")
+	producer.SetEncryption(newKeyRing(t, "k2", "k2"))
+	producer.SendMessage("ok")
+
+	consumer := account.GetQueue("queue-test-001")
+	consumer.SetEncryption(newKeyRing(t, "k2", "k2"))
+	msgs, err := consumer.BatchReceiveMessage(16, 0)
+	if len(msgs) != 2 || msgs[0].MsgBody != "plain" || msgs[1].MsgBody != "ok" {
+		t.Fatalf("unexpected messages: %v", msgs)
+	}
+	var failed *cmq_go.BatchDecodeError
+	if !errors.As(err, &failed) || len(failed.Failures) != 1 {
+		t.Fatalf("expected BatchDecodeError, got %v", err)
+	}
+	f := failed.Failures[0]
+	if f.Message.MsgId != badId || f.Queue != consumer || !strings.Contains(f.Message.MsgBody, "encryption-key-id=k1") {
+		t.Errorf("unexpected failure: %+v", f)
+	}
+	var decryptErr *cmq_go.DecryptError
+	if !errors.As(err, &decryptErr) || decryptErr.MsgId != badId {
+		t.Errorf("DecryptError not reachable: %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package offline
+
+import (
+	"testing"
+
+	cmq_go "github.com/glutwins/cmq-go"
+)
+
+// 消息头随信封发送，接收时解析；消息头的键转为小写，值和消息体中的特殊字符保持原样
+func Test_EnvelopeHeaders(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+
+	queue := cmq_go.NewAccount(server.URL, secretId, secretKey).GetQueue("queue-test-001")
+	headers := map[string]string{
+		cmq_go.HeaderContentType: "application/json",
+		"Correlation-ID":         "a=1&b=2\nc",
+	}
+	body := "{\"hello\":\"world\"}\n~cmq/1 x=y\n"
+	if _, err := queue.SendMessageWithHeaders(body, headers); err != nil {
+		t.Fatal(err)
+	}
+	queue.SetEnvelope(true)
+	queue.SendMessage("no headers")
+
+	msgs, err := queue.BatchReceiveMessage(16, 0)
+	if err != nil || len(msgs) != 2 {
+		t.Fatalf("receive: %v %v", msgs, err)
+	}
+	if msgs[0].MsgBody != body {
+		t.Errorf("unexpected body: %q", msgs[0].MsgBody)
+	}
+	if len(msgs[0].Headers) != 2 || msgs[0].Headers[cmq_go.HeaderContentType] != "application/json" || msgs[0].Headers[cmq_go.HeaderCorrelationID] != "a=1&b=2\nc" {
+		t.Errorf("unexpected headers: %v", msgs[0].Headers)
+	}
+	if msgs[1].MsgBody != "no headers" || msgs[1].Headers == nil || len(msgs[1].Headers) != 0 {
+		t.Errorf("unexpected message: %q %v", msgs[1].MsgBody, msgs[1].Headers)
+	}
+}
+
+// 非信封格式和无法识别版本的消息体原样返回，Headers 为nil
+func Test_EnvelopePassthrough(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+
+	queue := cmq_go.NewAccount(server.URL, secretId, secretKey).GetQueue("queue-test-001")
+	raws := []string{"plain", "~cmq/2 a=b\nbody", "~cmq/x a=b\nbody", "~cmq/1 no-newline", "~cmq/0 a=b\nbody"}
+	for _, raw := range raws {
+		queue.SendMessage(raw)
+	}
+	queue.SetEnvelope(true)
+
+	msgs, err := queue.BatchReceiveMessage(16, 0)
+	if err != nil || len(msgs) != len(raws) {
+		t.Fatalf("receive: %v %v", msgs, err)
+	}
+	for i, msg := range msgs {
+		if msg.MsgBody != raws[i] || msg.Headers != nil {
+			t.Errorf("%q decoded as %q %v", raws[i], msg.MsgBody, msg.Headers)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+// offline 包中的测试均运行在内存中的fakeCMQ上，不需要腾讯云账号：
+//
+//	go test ./test/offline/
+//
+// outbox与幂等相关的测试依赖 github.com/mattn/go-sqlite3 (需要cgo)。
+package offline
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// fakeCMQ 不校验签名，任意密钥均可
+var secretId = "YourTencentSecretId"
+var secretKey = "YourTencentSecretKey"
+
+// fakeCMQ 内存中的CMQ服务端，用于不依赖腾讯云账号的测试
+type fakeCMQ struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	down   bool
+	seq    int
+	queues map[string][]*fakeMsg
+	topics map[string][]string
+	calls  map[string]int
+
+	maxMsgHeapNum int
+	latency       time.Duration
+	visibility    time.Duration
+}
+
+type fakeMsg struct {
+	id          string
+	body        string
+	handle      string
+	visibleAt   time.Time
+	enqueueTime time.Time
+	dequeue     int
+}
+
+func newFakeCMQ() *fakeCMQ {
+	f := &fakeCMQ{queues: make(map[string][]*fakeMsg), topics: make(map[string][]string), calls: make(map[string]int),
+		maxMsgHeapNum: 1000000, visibility: 30 * time.Second}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+// setDown 模拟服务不可用，所有请求返回503
+func (f *fakeCMQ) setDown(down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.down = down
+}
+
+// setMaxMsgHeapNum 设置 GetQueueAttributes 返回的最大堆积数
+func (f *fakeCMQ) setMaxMsgHeapNum(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.maxMsgHeapNum = n
+}
+
+// setVisibilityTimeout 设置接收后消息不可见的时长
+func (f *fakeCMQ) setVisibilityTimeout(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.visibility = d
+}
+
+// setLatency 每个请求在处理前等待d，模拟慢速网络
+func (f *fakeCMQ) setLatency(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.latency = d
+}
+
+// count 返回收到的action请求数，包括服务不可用时的请求
+func (f *fakeCMQ) count(action string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[action]
+}
+
+// expire 使队列中所有消息立即可见，模拟可见性超时
+func (f *fakeCMQ) expire(queueName string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, m := range f.queues[queueName] {
+		m.visibleAt = time.Now()
+	}
+}
+
+// published 返回发布到主题的消息体
+func (f *fakeCMQ) published(topicName string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.topics[topicName]...)
+}
+
+func (f *fakeCMQ) bodies(queueName string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var bodies []string
+	for _, m := range f.queues[queueName] {
+		bodies = append(bodies, m.body)
+	}
+	return bodies
+}
+
+func (f *fakeCMQ) serve(w http.ResponseWriter, r *http.Request) {
+	// 客户端没有设置Content-Type，需要自行解析请求体
+	data, _ := ioutil.ReadAll(r.Body)
+	r.Form, _ = url.ParseQuery(string(data))
+	f.mu.Lock()
+	latency := f.latency
+	f.mu.Unlock()
+	time.Sleep(latency)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls[r.Form.Get("Action")]++
+	if f.down {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	resp := map[string]interface{}{"code": 0, "message": "", "requestId": "fake"}
+	queueName := r.Form.Get("queueName")
+	delay, _ := strconv.Atoi(r.Form.Get("delaySeconds"))
+	send := func(body string) string {
+		f.seq++
+		id := strconv.Itoa(f.seq)
+		now := time.Now()
+		f.queues[queueName] = append(f.queues[queueName], &fakeMsg{
+			id: id, body: body, enqueueTime: now, visibleAt: now.Add(time.Duration(delay) * time.Second),
+		})
+		return id
+	}
+	receive := func(n int) []map[string]interface{} {
+		var msgs []map[string]interface{}
+		now := time.Now()
+		for _, m := range f.queues[queueName] {
+			if len(msgs) == n {
+				break
+			}
+			if m.visibleAt.After(now) {
+				continue
+			}
+			f.seq++
+			m.handle = strconv.Itoa(f.seq)
+			m.dequeue++
+			m.visibleAt = now.Add(f.visibility)
+			msgs = append(msgs, map[string]interface{}{
+				"msgId": m.id, "receiptHandle": m.handle, "msgBody": m.body,
+				"enqueueTime": m.enqueueTime.UnixNano() / 1e6, "nextVisibleTime": m.visibleAt.UnixNano() / 1e6,
+				"dequeueCount": m.dequeue,
+			})
+		}
+		return msgs
+	}
+	remove := func(handle string) {
+		msgs := f.queues[queueName]
+		for i, m := range msgs {
+			if m.handle == handle {
+				f.queues[queueName] = append(msgs[:i:i], msgs[i+1:]...)
+				return
+			}
+		}
+	}
+
+	switch r.Form.Get("Action") {
+	case "SendMessage":
+		resp["msgId"] = send(r.Form.Get("msgBody"))
+	case "BatchSendMessage":
+		var list []map[string]string
+		for i := 1; r.Form.Get("msgBody."+strconv.Itoa(i)) != ""; i++ {
+			list = append(list, map[string]string{"msgId": send(r.Form.Get("msgBody." + strconv.Itoa(i)))})
+		}
+		resp["msgList"] = list
+	case "BatchPublishMessage":
+		topicName := r.Form.Get("topicName")
+		var list []map[string]string
+		for i := 1; r.Form.Get("msgBody."+strconv.Itoa(i)) != ""; i++ {
+			f.topics[topicName] = append(f.topics[topicName], r.Form.Get("msgBody."+strconv.Itoa(i)))
+			list = append(list, map[string]string{"msgId": strconv.Itoa(i)})
+		}
+		resp["msgList"] = list
+	case "ReceiveMessage":
+		if msgs := receive(1); len(msgs) > 0 {
+			for k, v := range msgs[0] {
+				resp[k] = v
+			}
+		} else {
+			resp["code"], resp["message"] = 7000, "no message"
+		}
+	case "BatchReceiveMessage":
+		n, _ := strconv.Atoi(r.Form.Get("numOfMsg"))
+		if msgs := receive(n); len(msgs) > 0 {
+			resp["msgInfoList"] = msgs
+		} else {
+			resp["code"], resp["message"] = 7000, "no message"
+		}
+	case "DeleteMessage":
+		remove(r.Form.Get("receiptHandle"))
+	case "BatchDeleteMessage":
+		for i := 1; r.Form.Get("receiptHandle."+strconv.Itoa(i)) != ""; i++ {
+			remove(r.Form.Get("receiptHandle." + strconv.Itoa(i)))
+		}
+	case "GetQueueAttributes":
+		resp["maxMsgSize"] = 65536
+		resp["maxMsgHeapNum"] = f.maxMsgHeapNum
+		resp["visibilityTimeout"] = int(f.visibility / time.Second)
+		resp["activeMsgNum"] = len(f.queues[queueName])
+	case "ListQueue":
+		var names []string
+		for name := range f.queues {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		offset, _ := strconv.Atoi(r.Form.Get("offset"))
+		limit, _ := strconv.Atoi(r.Form.Get("limit"))
+		var list []map[string]string
+		for i := offset; i < len(names) && i < offset+limit; i++ {
+			list = append(list, map[string]string{"queueName": names[i]})
+		}
+		resp["totalCount"], resp["queueList"] = len(names), list
+	default:
+		resp["code"], resp["message"] = 4000, "unsupported action"
+	}
+	json.NewEncoder(w).Encode(resp)
+}
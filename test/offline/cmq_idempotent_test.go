@@ -0,0 +1,54 @@
+package offline
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	cmq_go "github.com/glutwins/cmq-go"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// 处理成功的消息再次投递时被跳过，处理失败时去重记录随事务回滚
+func Test_IdempotentSQL(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "dedup.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	store := cmq_go.NewSQLDedupStore(db, "cmq_dedup")
+	if err = store.CreateTable(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := 0
+	fail := true
+	handler := cmq_go.Idempotent(store, time.Hour)(func(ctx context.Context, msg cmq_go.Message) error {
+		calls++
+		if cmq_go.TxFromContext(ctx) == nil {
+			t.Error("no transaction in context")
+		}
+		if fail {
+			return errors.New("fail")
+		}
+		return nil
+	})
+
+	msg := cmq_go.Message{MsgId: "msg-001"}
+	if err = handler(ctx, msg); err == nil {
+		t.Fatal("expected handler error")
+	}
+	fail = false
+	for i := 0; i < 2; i++ {
+		if err = handler(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("handler called %d times, want 2", calls)
+	}
+}
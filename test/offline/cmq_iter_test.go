@@ -0,0 +1,55 @@
+package offline
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	cmq_go "github.com/glutwins/cmq-go"
+)
+
+// 队列为空时 All 结束遍历
+func Test_QueueAll(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+
+	queue := cmq_go.NewAccount(server.URL, secretId, secretKey).GetQueue("queue-test-001")
+	queue.BatchSendMessage([]string{"a", "b", "c"})
+
+	var bodies []string
+	for msg, err := range queue.All(context.Background(), cmq_go.ReceiveOptions{PollingWaitSeconds: -1}) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		bodies = append(bodies, msg.MsgBody)
+		queue.DeleteMessage(msg.ReceiptHandle)
+	}
+	if len(bodies) != 3 {
+		t.Errorf("unexpected messages: %v", bodies)
+	}
+}
+
+// Queues 自动翻页列出所有队列
+func Test_AccountQueues(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+
+	account := cmq_go.NewAccount(server.URL, secretId, secretKey)
+	for i := 0; i < 120; i++ {
+		account.GetQueue(fmt.Sprintf("queue-test-%03d", i)).SendMessage("a")
+	}
+
+	n := 0
+	for name, err := range account.Queues(context.Background(), "") {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("queue-test-%03d", n); name != want {
+			t.Fatalf("got %s, want %s", name, want)
+		}
+		n++
+	}
+	if n != 120 {
+		t.Errorf("listed %d queues, want 120", n)
+	}
+}
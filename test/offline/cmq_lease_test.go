@@ -0,0 +1,68 @@
+package offline
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cmq_go "github.com/glutwins/cmq-go"
+)
+
+// 处理函数的ctx在消息重新可见前 DeadlineMargin 到期；处理超过 NextVisibleTime 后不删除消息
+func Test_ConsumerLeaseLost(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+	server.setVisibilityTimeout(300 * time.Millisecond)
+
+	queue := cmq_go.NewAccount(server.URL, secretId, secretKey).GetQueue("queue-test-001")
+	queue.SendMessage("a")
+
+	var calls int64
+	var deadlineErr error
+	var reported []error
+	consumer := cmq_go.NewConsumer(queue, func(ctx context.Context, msg cmq_go.Message) error {
+		if atomic.AddInt64(&calls, 1) > 1 {
+			return errors.New("redelivered")
+		}
+		<-ctx.Done()
+		deadlineErr = ctx.Err()
+		time.Sleep(200 * time.Millisecond)
+		return nil
+	})
+	consumer.Concurrency = 1
+	consumer.PollingWaitSeconds = 0
+	consumer.DeadlineMargin = 100 * time.Millisecond
+	consumer.OnError = func(msg *cmq_go.Message, err error) { reported = append(reported, err) }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for deadline := time.Now().Add(5 * time.Second); consumer.Stats().LeaseLost == 0; {
+			if time.Now().After(deadline) {
+				t.Error("timeout")
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		cancel()
+	}()
+	consumer.Run(ctx)
+
+	if deadlineErr != context.DeadlineExceeded {
+		t.Errorf("handler ctx: %v", deadlineErr)
+	}
+	if stats := consumer.Stats(); stats.LeaseLost != 1 || stats.Overruns != 1 || stats.Handled != 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	var lost *cmq_go.LeaseLostError
+	if len(reported) == 0 || !errors.As(reported[0], &lost) || lost.Overrun <= 0 {
+		t.Errorf("LeaseLostError not reported: %v", reported)
+	}
+	if n := server.count("DeleteMessage") + server.count("BatchDeleteMessage"); n != 0 {
+		t.Errorf("message deleted after lease lost: %d requests", n)
+	}
+	if bodies := server.bodies("queue-test-001"); len(bodies) != 1 {
+		t.Errorf("unexpected queue messages: %v", bodies)
+	}
+}
@@ -0,0 +1,68 @@
+package offline
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	cmq_go "github.com/glutwins/cmq-go"
+)
+
+// 先传入的中间件在外层
+func Test_Chain(t *testing.T) {
+	var order []string
+	mark := func(name string) cmq_go.Middleware {
+		return func(next cmq_go.Handler) cmq_go.Handler {
+			return func(ctx context.Context, msg cmq_go.Message) error {
+				order = append(order, name)
+				return next(ctx, msg)
+			}
+		}
+	}
+	handler := cmq_go.Chain(func(ctx context.Context, msg cmq_go.Message) error {
+		order = append(order, "handler")
+		return nil
+	}, mark("a"), mark("b"))
+	handler(context.Background(), cmq_go.Message{})
+	if len(order) != 3 || order[0] != "a" || order[1] != "b" || order[2] != "handler" {
+		t.Errorf("unexpected order: %v", order)
+	}
+}
+
+// panic 转为 PanicError 并计入失败
+func Test_RecoverMetrics(t *testing.T) {
+	metrics := &cmq_go.HandlerMetrics{}
+	handler := cmq_go.Chain(func(ctx context.Context, msg cmq_go.Message) error {
+		panic("boom")
+	}, cmq_go.Metrics(metrics.Observe), cmq_go.Recover())
+
+	err := handler(context.Background(), cmq_go.Message{MsgId: "1"})
+	var panicErr *cmq_go.PanicError
+	if !errors.As(err, &panicErr) || panicErr.Value != "boom" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stats := metrics.Stats(); stats.Failed != 1 || stats.Panics != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+// 从消息头提取 traceparent，超时后ctx被取消
+func Test_TraceTimeout(t *testing.T) {
+	msg := cmq_go.Message{Headers: map[string]string{
+		cmq_go.HeaderTraceParent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		cmq_go.HeaderTraceState:  "congo=t61rcWkgMzE",
+	}}
+	handler := cmq_go.Chain(func(ctx context.Context, msg cmq_go.Message) error {
+		trace, ok := cmq_go.TraceFromContext(ctx)
+		if !ok || trace.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || trace.TraceState != "congo=t61rcWkgMzE" {
+			t.Errorf("unexpected trace: %+v", trace)
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	}, cmq_go.Trace(), cmq_go.Timeout(10*time.Millisecond))
+
+	if err := handler(context.Background(), msg); err != context.DeadlineExceeded {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+package offline
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	cmq_go "github.com/glutwins/cmq-go"
+)
+
+// 分区键相同的消息按接收顺序依次处理，不同分区键的消息并发处理
+func Test_ConsumerPartitionKey(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+
+	queue := cmq_go.NewAccount(server.URL, secretId, secretKey).GetQueue("queue-test-001")
+	queue.BatchSendMessage([]string{"a1", "b1", "a2", "b2", "a3", "b3"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var mu sync.Mutex
+	order := make(map[string][]string)
+	active := make(map[string]int)
+	started := map[string]chan struct{}{"a": make(chan struct{}), "b": make(chan struct{})}
+	handled := 0
+	consumer := cmq_go.NewConsumer(queue, func(ctx context.Context, msg cmq_go.Message) error {
+		key, other := msg.MsgBody[:1], map[string]string{"a": "b", "b": "a"}[msg.MsgBody[:1]]
+		mu.Lock()
+		if active[key]++; active[key] > 1 {
+			t.Errorf("partition %s handled concurrently", key)
+		}
+		mu.Unlock()
+
+		// 两个分区的第一条消息互相等待，只有并发处理时才能继续
+		if msg.MsgBody[1] == '1' {
+			close(started[key])
+			select {
+			case <-started[other]:
+			case <-time.After(2 * time.Second):
+				t.Errorf("partition %s not handled in parallel with %s", key, other)
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		defer mu.Unlock()
+		active[key]--
+		order[key] = append(order[key], msg.MsgBody)
+		if handled++; handled == 6 {
+			cancel()
+		}
+		return nil
+	})
+	consumer.Concurrency = 4
+	consumer.PollingWaitSeconds = 0
+	consumer.PartitionKey = func(msg cmq_go.Message) string { return msg.MsgBody[:1] }
+
+	done := make(chan error)
+	go func() { done <- consumer.Run(ctx) }()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("consumer did not stop")
+	}
+	for key, want := range map[string][]string{"a": {"a1", "a2", "a3"}, "b": {"b1", "b2", "b3"}} {
+		if got := order[key]; len(got) != 3 || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+			t.Errorf("partition %s handled out of order: %v", key, got)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package offline
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	cmq_go "github.com/glutwins/cmq-go"
+)
+
+func newPriorityQueue(t *testing.T, server *fakeCMQ, strategy int, weights ...int) *cmq_go.PriorityQueue {
+	account := cmq_go.NewAccount(server.URL, secretId, secretKey)
+	pq := cmq_go.NewPriorityQueue(strategy)
+	for i, weight := range weights {
+		pq.AddLevel(i+1, account.GetQueue(fmt.Sprintf("queue-test-%03d", i+1)), weight)
+		for j := 0; j < 8; j++ {
+			if _, err := pq.SendMessage("a", i+1); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return pq
+}
+
+func receivePriorities(t *testing.T, pq *cmq_go.PriorityQueue, n int) []int {
+	var priorities []int
+	for i := 0; i < n; i++ {
+		msgs, err := pq.BatchReceiveMessage(1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		priorities = append(priorities, msgs[0].Priority)
+	}
+	return priorities
+}
+
+// PriorityStrict 总是先消费高优先级队列
+func Test_PriorityStrict(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+	pq := newPriorityQueue(t, server, cmq_go.PriorityStrict, 1, 1)
+
+	for i, p := range receivePriorities(t, pq, 10) {
+		want := 2
+		if i >= 8 {
+			want = 1
+		}
+		if p != want {
+			t.Errorf("message %d: priority %d, want %d", i, p, want)
+		}
+	}
+}
+
+// PriorityStrict 低优先级队列超过 StarvationTimeout 未被消费时优先消费一次
+func Test_PriorityStarvation(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+	pq := newPriorityQueue(t, server, cmq_go.PriorityStrict, 1, 1)
+	pq.StarvationTimeout = 50 * time.Millisecond
+
+	if p := receivePriorities(t, pq, 1)[0]; p != 2 {
+		t.Errorf("priority %d, want 2", p)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if p := receivePriorities(t, pq, 2); p[0] != 1 || p[1] != 2 {
+		t.Errorf("priorities %v, want [1 2]", p)
+	}
+}
+
+// PriorityWeighted 按权重比例轮流消费
+func Test_PriorityWeighted(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+	pq := newPriorityQueue(t, server, cmq_go.PriorityWeighted, 1, 2)
+
+	counts := map[int]int{}
+	for _, p := range receivePriorities(t, pq, 6) {
+		counts[p]++
+	}
+	if counts[2] != 4 || counts[1] != 2 {
+		t.Errorf("unexpected counts: %v", counts)
+	}
+}
+
+// 解码失败的消息在 BatchDecodeError 中返回，不在消息列表中
+func Test_PriorityDecodeError(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+
+	account := cmq_go.NewAccount(server.URL, secretId, secretKey)
+	keys, _ := cmq_go.NewKeyRing("k1", map[string][]byte{"k1": make([]byte, 32)})
+	producer := account.GetQueue("queue-test-001")
+	producer.SetEncryption(keys)
+	producer.SendMessage("secret")
+
+	pq := cmq_go.NewPriorityQueue(cmq_go.PriorityStrict)
+	low := account.GetQueue("queue-test-001")
+	pq.AddLevel(1, low, 1)
+	pq.AddLevel(2, account.GetQueue("queue-test-002"), 1)
+	account.GetQueue("queue-test-002").SendMessage("plain")
+	msgs, err := pq.BatchReceiveMessage(16, 0)
+	if len(msgs) != 1 || msgs[0].MsgBody != "plain" {
+		t.Errorf("unexpected messages: %v", msgs)
+	}
+	var failed *cmq_go.BatchDecodeError
+	if !errors.As(err, &failed) || len(failed.Failures) != 1 || failed.Failures[0].Queue != low {
+		t.Errorf("expected BatchDecodeError: %v", err)
+	}
+}
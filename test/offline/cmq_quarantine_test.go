@@ -0,0 +1,123 @@
+package offline
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cmq_go "github.com/glutwins/cmq-go"
+)
+
+// 解码失败的消息写入隔离文件并删除，之后可以按原始内容重新发送
+func Test_QuarantineResubmit(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+
+	dir, err := os.MkdirTemp("", "quarantine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "quarantine.jsonl")
+	quarantine, err := cmq_go.NewQuarantine(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer quarantine.Close()
+	// 每条记录轮转一次
+	quarantine.MaxSize = 1
+
+	queue := cmq_go.NewAccount(server.URL, secretId, secretKey).GetQueue("queue-test-001")
+	bad := "~cmq/1 content-encoding=bogus\nabc"
+	queue.BatchSendMessage([]string{bad, "ok", bad})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var handled int64
+	consumer := cmq_go.NewConsumer(queue, func(ctx context.Context, msg cmq_go.Message) error {
+		atomic.AddInt64(&handled, 1)
+		return nil
+	})
+	consumer.PollingWaitSeconds = 0
+	consumer.Quarantine = quarantine
+	go func() {
+		for consumer.Stats().Quarantined < 2 || atomic.LoadInt64(&handled) < 1 {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+	}()
+	consumer.Run(ctx)
+
+	if bodies := server.bodies("queue-test-001"); len(bodies) != 0 {
+		t.Fatalf("messages not deleted: %v", bodies)
+	}
+	records, err := cmq_go.ReadQuarantine(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || !records[0].Info.Raw || records[0].Message.MsgBody != bad || records[1].Info.LastError == "" {
+		t.Fatalf("unexpected records: %+v", records)
+	}
+
+	if _, err = cmq_go.Resubmit(context.Background(), queue, records[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if bodies := server.bodies("queue-test-001"); len(bodies) != 1 || bodies[0] != bad {
+		t.Errorf("unexpected resubmitted messages: %v", bodies)
+	}
+}
+
+// 解码失败的消息隔离后保留 claim check 的数据，重新发送后仍可以解码
+func Test_QuarantineKeepsClaimCheck(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+
+	dir := t.TempDir()
+	store, err := cmq_go.NewFileBlobStore(filepath.Join(dir, "blobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	quarantine, err := cmq_go.NewQuarantine(filepath.Join(dir, "quarantine.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer quarantine.Close()
+	keys, _ := cmq_go.NewKeyRing("k1", map[string][]byte{"k1": make([]byte, 32)})
+
+	account := cmq_go.NewAccount(server.URL, secretId, secretKey)
+	producer := account.GetQueue("queue-test-001")
+	producer.SetClaimCheck(store, 1)
+	producer.SetEncryption(keys)
+	if _, err = producer.SendMessage("secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 消费方没有密钥，解密失败
+	queue := account.GetQueue("queue-test-001")
+	queue.SetClaimCheck(store, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	consumer := cmq_go.NewConsumer(queue, func(ctx context.Context, msg cmq_go.Message) error { return nil })
+	consumer.PollingWaitSeconds = 0
+	consumer.Quarantine = quarantine
+	go func() {
+		for consumer.Stats().Quarantined < 1 {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+	}()
+	consumer.Run(ctx)
+
+	records, err := cmq_go.ReadQuarantine(filepath.Join(dir, "quarantine.jsonl"))
+	if err != nil || len(records) != 1 {
+		t.Fatalf("unexpected records: %v %v", records, err)
+	}
+	if _, err = cmq_go.Resubmit(context.Background(), queue, records); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := producer.BatchReceiveMessage(16, 0)
+	if err != nil || len(msgs) != 1 || msgs[0].MsgBody != "secret" {
+		t.Fatalf("resubmitted message not decodable: %v %v", msgs, err)
+	}
+}
@@ -0,0 +1,85 @@
+package offline
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	cmq_go "github.com/glutwins/cmq-go"
+)
+
+// 重试延时按倍数增长，不超过 MaxDelay 和 MaxDelaySeconds
+func Test_RetryPolicyDelay(t *testing.T) {
+	policy := cmq_go.RetryPolicy{InitialDelay: time.Second, Multiplier: 2, MaxDelay: 5 * time.Second}
+	for attempt, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 10: 5 * time.Second} {
+		if got := policy.Delay(attempt); got != want {
+			t.Errorf("Delay(%d) = %v, want %v", attempt, got, want)
+		}
+	}
+	policy.MaxDelay = 0
+	if got, want := policy.Delay(100), time.Duration(cmq_go.MaxDelaySeconds)*time.Second; got != want {
+		t.Errorf("Delay(100) = %v, want %v", got, want)
+	}
+	if got := (cmq_go.RetryPolicy{}).Delay(3); got != 4*time.Second {
+		t.Errorf("default Delay(3) = %v, want 4s", got)
+	}
+}
+
+// 处理失败的消息带着递增的 attempt 重新入队，原消息被删除
+func Test_RetryRequeue(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+
+	queue := cmq_go.NewAccount(server.URL, secretId, secretKey).GetQueue("queue-test-001")
+	queue.SendMessage("a")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var mu sync.Mutex
+	var seen []cmq_go.Message
+	consumer := cmq_go.NewConsumer(queue, func(ctx context.Context, msg cmq_go.Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+		seen = append(seen, msg)
+		// 重新入队后原消息已删除，队列中只有当前这一条
+		if bodies := server.bodies("queue-test-001"); len(bodies) != 1 {
+			t.Errorf("delivery %d: queue messages %v", len(seen), bodies)
+		}
+		if len(seen) < 3 {
+			return errors.New("retry")
+		}
+		cancel()
+		return nil
+	})
+	consumer.PollingWaitSeconds = 0
+	consumer.ErrorBackoff = 50 * time.Millisecond
+	consumer.Retry = &cmq_go.RetryPolicy{InitialDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+	done := make(chan error)
+	go func() { done <- consumer.Run(ctx) }()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("consumer did not finish")
+	}
+
+	if len(seen) != 3 {
+		t.Fatalf("handled %d times, want 3", len(seen))
+	}
+	for i, msg := range seen {
+		want := ""
+		if i > 0 {
+			want = string(rune('0' + i))
+		}
+		if msg.Headers[cmq_go.HeaderAttempt] != want || msg.DequeueCount != 1 || msg.MsgBody != "a" {
+			t.Errorf("delivery %d: attempt %q dequeueCount %d body %q", i, msg.Headers[cmq_go.HeaderAttempt], msg.DequeueCount, msg.MsgBody)
+		}
+	}
+	if stats := consumer.Stats(); stats.Retried != 2 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	if bodies := server.bodies("queue-test-001"); len(bodies) != 0 {
+		t.Errorf("original messages not deleted: %v", bodies)
+	}
+}
@@ -0,0 +1,54 @@
+package offline
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	cmq_go "github.com/glutwins/cmq-go"
+)
+
+// 超过延时上限的消息在到期前被透明地转发，转发对接收方不可见
+func Test_SendMessageAt(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+	defer func(max int) { cmq_go.MaxDelaySeconds = max }(cmq_go.MaxDelaySeconds)
+	cmq_go.MaxDelaySeconds = 1
+
+	queue := cmq_go.NewAccount(server.URL, secretId, secretKey).GetQueue("queue-test-001")
+	start := time.Now()
+	at := start.Add(2500 * time.Millisecond)
+	if _, err := queue.SendMessageAt(context.Background(), "a", at); err != nil {
+		t.Fatal(err)
+	}
+
+	hopped := false
+	for time.Since(start) < 5*time.Second {
+		msgs, err := queue.BatchReceiveMessage(16, 0)
+		if err == nil {
+			// 距离投递时间不足1秒的宽限期内交给接收方
+			if elapsed := time.Since(start); elapsed < 1500*time.Millisecond {
+				t.Errorf("delivered after %v, before deliver-at", elapsed)
+			}
+			if len(msgs) != 1 || msgs[0].MsgBody != "a" {
+				t.Fatalf("unexpected messages: %v", msgs)
+			}
+			if _, found := msgs[0].Headers[cmq_go.HeaderDeliverAt]; found {
+				t.Errorf("schedule headers exposed: %v", msgs[0].Headers)
+			}
+			if _, found := msgs[0].Headers[cmq_go.HeaderDeliveryHops]; found {
+				t.Errorf("schedule headers exposed: %v", msgs[0].Headers)
+			}
+			if !hopped {
+				t.Error("message was not forwarded")
+			}
+			return
+		}
+		if bodies := server.bodies("queue-test-001"); len(bodies) == 1 && strings.Contains(bodies[0], "delivery-hops=1") {
+			hopped = true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatal("message not delivered")
+}
@@ -0,0 +1,50 @@
+package offline
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	cmq_go "github.com/glutwins/cmq-go"
+)
+
+// 超过 MaxMsgSize 的消息在本地被拒绝，批量发送按URL编码后的总长度计算
+func Test_SizeCheck(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+
+	queue := cmq_go.NewAccount(server.URL, secretId, secretKey).GetQueue("queue-test-001")
+	queue.SetSizeCheck(time.Minute)
+
+	var tooLarge *cmq_go.MessageTooLargeError
+	if _, err := queue.SendMessage(strings.Repeat("a", 65537)); !errors.As(err, &tooLarge) || tooLarge.MaxMsgSize != 65536 {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := queue.SendMessage(strings.Repeat("a", 65536)); err != nil {
+		t.Error(err)
+	}
+	// 每条不超过上限，但URL编码后合计超过
+	if _, err := queue.BatchSendMessage([]string{strings.Repeat("&", 20000), strings.Repeat("&", 20000)}); !errors.As(err, &tooLarge) || tooLarge.Size != 120000 {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(server.bodies("queue-test-001")) != 1 {
+		t.Error("rejected messages were sent")
+	}
+}
+
+// 获取队列属性失败后短时间内不再获取
+func Test_SizeCheckOutage(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+
+	queue := cmq_go.NewAccount(server.URL, secretId, secretKey).GetQueue("queue-test-001")
+	queue.SetSizeCheck(time.Minute)
+	server.setDown(true)
+	for i := 0; i < 3; i++ {
+		queue.SendMessage("a")
+	}
+	if n := server.count("GetQueueAttributes"); n != 1 {
+		t.Errorf("GetQueueAttributes called %d times during outage", n)
+	}
+}
@@ -0,0 +1,99 @@
+package offline
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	cmq_go "github.com/glutwins/cmq-go"
+)
+
+// 服务不可用时消息写入暂存区，恢复后按顺序转发
+func Test_SpoolForward(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+	dir := t.TempDir()
+
+	spool, err := cmq_go.NewSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue := cmq_go.NewAccount(server.URL, secretId, secretKey).GetQueue("queue-test-001")
+	queue.SetSpool(spool)
+
+	server.setDown(true)
+	for _, body := range []string{"a", "b"} {
+		if _, err = queue.SendMessage(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server.setDown(false)
+	// 暂存区非空时新消息也进入暂存区
+	queue.SendMessage("c")
+	if stats := spool.Stats(); stats.Depth != 3 || stats.OldestAge <= 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	// 重新打开暂存区，模拟进程重启
+	spool, _ = cmq_go.NewSpool(dir)
+	queue.SetSpool(spool)
+	if err = spool.Forward(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if bodies := server.bodies("queue-test-001"); len(bodies) != 3 || bodies[0] != "a" || bodies[2] != "c" {
+		t.Errorf("unexpected queue messages: %v", bodies)
+	}
+	if stats := spool.Stats(); stats.Depth != 0 || stats.Forwarded != 3 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+// 重启后没有注册的目标不阻塞其他消息，使用 SetAccount 的账号转发，没有账号时写入 rejected.jsonl
+func Test_SpoolForwardUnregistered(t *testing.T) {
+	server := newFakeCMQ()
+	defer server.Close()
+	account := cmq_go.NewAccount(server.URL, secretId, secretKey)
+
+	spool := func(dir string) *cmq_go.Spool {
+		spool, err := cmq_go.NewSpool(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		queue1, queue2 := account.GetQueue("queue-test-001"), account.GetQueue("queue-test-002")
+		queue1.SetSpool(spool)
+		queue2.SetSpool(spool)
+		server.setDown(true)
+		queue1.SendMessage("a")
+		queue2.SendMessage("b")
+		server.setDown(false)
+
+		spool, _ = cmq_go.NewSpool(dir)
+		account.GetQueue("queue-test-002").SetSpool(spool)
+		return spool
+	}
+
+	dir := t.TempDir()
+	s := spool(dir)
+	if err := s.Forward(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if stats := s.Stats(); stats.Depth != 0 || stats.Forwarded != 1 || stats.Rejected != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "rejected.jsonl")); err != nil {
+		t.Error(err)
+	}
+
+	s = spool(t.TempDir())
+	s.SetAccount(account)
+	if err := s.Forward(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if stats := s.Stats(); stats.Depth != 0 || stats.Forwarded != 2 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	if bodies := server.bodies("queue-test-001"); len(bodies) != 1 || bodies[0] != "a" {
+		t.Errorf("unexpected queue messages: %v", bodies)
+	}
+}
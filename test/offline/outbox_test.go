@@ -0,0 +1,162 @@
+package offline
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	cmq_go "github.com/glutwins/cmq-go"
+	"github.com/glutwins/cmq-go/outbox"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func openOutbox(t *testing.T) (*sql.DB, *outbox.Outbox) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "outbox.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	box := outbox.New(outbox.SQLite, "cmq_outbox")
+	if err = box.CreateTable(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	return db, box
+}
+
+// 事务提交后消息被投递，回滚的消息不会投递
+func Test_OutboxRelay(t *testing.T) {
+	ctx := context.Background()
+	server := newFakeCMQ()
+	defer server.Close()
+	db, box := openOutbox(t)
+
+	tx, _ := db.Begin()
+	for _, body := range []string{"a", "b", "c"} {
+		if err := box.SendMessage(ctx, tx, "queue-test-001", body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	box.PublishMessage(ctx, tx, "topic-test-001", "t")
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	tx, _ = db.Begin()
+	box.SendMessage(ctx, tx, "queue-test-001", "rollback")
+	tx.Rollback()
+
+	account := cmq_go.NewAccount(server.URL, secretId, secretKey)
+	relay := outbox.NewRelay(db, box)
+	relay.RegisterQueue("queue-test-001", account.GetQueue("queue-test-001"))
+	relay.RegisterTopic("topic-test-001", account.GetTopic("topic-test-001"))
+
+	n, err := relay.Flush(ctx)
+	if err != nil || n != 4 {
+		t.Fatalf("Flush: %d %v", n, err)
+	}
+	if bodies := server.bodies("queue-test-001"); len(bodies) != 3 || bodies[0] != "a" || bodies[2] != "c" {
+		t.Errorf("unexpected queue messages: %v", bodies)
+	}
+	if n, err = relay.Flush(ctx); err != nil || n != 0 {
+		t.Errorf("outbox not drained: %d %v", n, err)
+	}
+}
+
+// 目标未注册时消息保留在表中并记录错误
+func Test_OutboxRelayUnregistered(t *testing.T) {
+	ctx := context.Background()
+	db, box := openOutbox(t)
+
+	tx, _ := db.Begin()
+	box.SendMessage(ctx, tx, "queue-unknown", "a")
+	tx.Commit()
+
+	relay := outbox.NewRelay(db, box)
+	if _, err := relay.Flush(ctx); err == nil {
+		t.Fatal("expected error for unregistered queue")
+	}
+	var attempts int
+	var lastError string
+	db.QueryRow("SELECT attempts, last_error FROM cmq_outbox").Scan(&attempts, &lastError)
+	if attempts != 1 || lastError == "" {
+		t.Errorf("failure not recorded: %d %q", attempts, lastError)
+	}
+}
+
+// 失败的消息多于 BatchSize 时不阻塞之后的消息
+func Test_OutboxRelayFailedRowsSkipped(t *testing.T) {
+	ctx := context.Background()
+	server := newFakeCMQ()
+	defer server.Close()
+	db, box := openOutbox(t)
+
+	tx, _ := db.Begin()
+	box.SendMessage(ctx, tx, "queue-unknown", "a")
+	box.SendMessage(ctx, tx, "queue-unknown", "b")
+	box.SendMessage(ctx, tx, "queue-test-001", "c")
+	tx.Commit()
+
+	relay := outbox.NewRelay(db, box)
+	relay.BatchSize = 2
+	relay.RegisterQueue("queue-test-001", cmq_go.NewAccount(server.URL, secretId, secretKey).GetQueue("queue-test-001"))
+	if _, err := relay.Flush(ctx); err == nil {
+		t.Fatal("expected error for unregistered queue")
+	}
+	if n, err := relay.Flush(ctx); err != nil || n != 1 {
+		t.Fatalf("Flush: %d %v", n, err)
+	}
+	if bodies := server.bodies("queue-test-001"); len(bodies) != 1 || bodies[0] != "c" {
+		t.Errorf("unexpected queue messages: %v", bodies)
+	}
+
+	// 达到 MaxAttempts 后不再投递
+	db.Exec("UPDATE cmq_outbox SET next_attempt_at = 0")
+	relay.MaxAttempts = 2
+	if _, err := relay.Flush(ctx); err == nil {
+		t.Fatal("expected error for unregistered queue")
+	}
+	if n, err := relay.Flush(ctx); err != nil || n != 0 {
+		t.Errorf("parked rows retried: %d %v", n, err)
+	}
+	var parked int
+	db.QueryRow("SELECT COUNT(*) FROM cmq_outbox WHERE attempts = 2").Scan(&parked)
+	if parked != 2 {
+		t.Errorf("parked rows: %d", parked)
+	}
+}
+
+// 一批中个别消息出错时只有该消息记为失败，同批其它消息照常投递
+func Test_OutboxRelayBadRowInBatch(t *testing.T) {
+	ctx := context.Background()
+	server := newFakeCMQ()
+	defer server.Close()
+	db, box := openOutbox(t)
+
+	tx, _ := db.Begin()
+	box.SendMessage(ctx, tx, "queue-test-001", "a")
+	box.SendMessage(ctx, tx, "queue-test-001", strings.Repeat("b", 70000))
+	box.SendMessage(ctx, tx, "queue-test-001", "c")
+	tx.Commit()
+
+	queue := cmq_go.NewAccount(server.URL, secretId, secretKey).GetQueue("queue-test-001")
+	queue.SetSizeCheck(time.Minute)
+	relay := outbox.NewRelay(db, box)
+	relay.RegisterQueue("queue-test-001", queue)
+
+	n, err := relay.Flush(ctx)
+	var tooLarge *cmq_go.MessageTooLargeError
+	if n != 2 || !errors.As(err, &tooLarge) {
+		t.Fatalf("Flush: %d %v", n, err)
+	}
+	if bodies := server.bodies("queue-test-001"); len(bodies) != 2 || bodies[0] != "a" || bodies[1] != "c" {
+		t.Errorf("unexpected queue messages: %v", bodies)
+	}
+	var left, attempts int
+	db.QueryRow("SELECT COUNT(*), MAX(attempts) FROM cmq_outbox").Scan(&left, &attempts)
+	if left != 1 || attempts != 1 {
+		t.Errorf("bad row not recorded: %d rows, %d attempts", left, attempts)
+	}
+}
@@ -1,19 +1,25 @@
 package cmq_go
 
 import (
+	"context"
 	"fmt"
 	"strconv"
+	"time"
 )
 
 type Topic struct {
 	topicName string
 	client    *CMQClient
+	codec     codec
+	spool     *Spool
+	dedup     *dedup
 }
 
 func NewTopic(topicName string, client *CMQClient) (queue *Topic) {
 	return &Topic{
 		topicName: topicName,
 		client:    client,
+		codec:     codec{fanout: true},
 	}
 }
 
@@ -64,8 +70,85 @@ func (this *Topic) GetTopicAttributes() (TopicMeta, error) {
 	return resp.TopicMeta, nil
 }
 
+// SetEnvelope 开启后发布的消息都使用信封格式
+func (this *Topic) SetEnvelope(enabled bool) {
+	this.codec.envelope = enabled
+}
+
+// SetCompression 消息体长度达到threshold(<=0时使用DefaultCompressThreshold)时使用c压缩，c为nil时关闭压缩
+func (this *Topic) SetCompression(c Compressor, threshold int) {
+	this.codec.setCompression(c, threshold)
+}
+
+func (this *Topic) CompressionStats() CompressionStats {
+	return this.codec.compressionStats()
+}
+
+// SetClaimCheck 编码后的消息体超过threshold(<=0时使用DefaultClaimCheckThreshold)时存入store，消息只携带引用，store为nil时关闭。
+// 主题消息的数据由多个订阅共享，删除消息时不会清理，需要定期清理(如 FileBlobStore.Purge)
+func (this *Topic) SetClaimCheck(store BlobStore, threshold int) {
+	this.codec.setClaimCheck(store, threshold)
+}
+
+// SetEncryption 使用keys提供的当前密钥以AES-GCM加密消息体，接收时按消息头中的密钥ID解密，keys为nil时关闭
+func (this *Topic) SetEncryption(keys KeyProvider) {
+	this.codec.keys = keys
+}
+
+// SetDedup 开启生产端去重，window(<=0时使用DefaultDedupWindow)内去重键相同的消息不再发布，直接返回第一次的msgId，
+// 第一次发布仍在进行或结果未知时返回空的msgId。store 不是 AtomicDedupStore(如 SQLDedupStore)时只在发布成功后记录，
+// 并发发布或超时后重试的消息仍会重复发布，需要可靠去重时消费端应使用 Idempotent 按 HeaderDedupKey 去重。store为nil时关闭
+func (this *Topic) SetDedup(store DedupStore, window time.Duration) {
+	this.dedup = newDedup(store, window)
+}
+
+// SetSpool 发布遇到网络错误或服务端5xx时把消息写入本地暂存区，由 Spool.Run 在恢复后转发，
+// 此时发布接口返回空的msgId和nil错误。spool为nil时关闭
+func (this *Topic) SetSpool(spool *Spool) {
+	this.spool = spool
+	if spool != nil {
+		spool.register(spoolKindTopic, this.topicName, this.client)
+	}
+}
+
 func (this *Topic) PublishMessage(message string, tagList []string) (string, error) {
-	return _publishMessage(this.client, this.topicName, message, tagList, "")
+	return this.publishMessage(message, tagList, nil)
+}
+
+// PublishMessageWithHeaders 以信封格式发布带消息头的消息
+func (this *Topic) PublishMessageWithHeaders(message string, tagList []string, headers map[string]string) (string, error) {
+	return this.publishMessage(message, tagList, headers)
+}
+
+// PublishMessageWithDedupKey 发布带去重键的消息，开启 SetDedup 时窗口内相同去重键的消息只发布一次
+func (this *Topic) PublishMessageWithDedupKey(message string, tagList []string, dedupKey string) (string, error) {
+	return this.publishMessage(message, tagList, map[string]string{HeaderDedupKey: dedupKey})
+}
+
+func (this *Topic) publishMessage(message string, tagList []string, headers map[string]string) (string, error) {
+	key := headers[HeaderDedupKey]
+	msgId, dup, reserved := this.dedup.reserve(this.topicName, key)
+	if dup {
+		return msgId, nil
+	}
+	msgId, err := this.deliver(message, tagList, headers)
+	this.dedup.finish(this.topicName, key, msgId, err, reserved)
+	return msgId, err
+}
+
+func (this *Topic) deliver(message string, tagList []string, headers map[string]string) (string, error) {
+	body, err := this.codec.encode(message, headers)
+	if err != nil {
+		return "", err
+	}
+	if this.spool != nil && this.spool.pending() {
+		return "", this.spool.append(newSpoolRecord(spoolKindTopic, this.topicName, body, 0, tagList))
+	}
+	msgId, err := _publishMessage(this.client, this.topicName, body, tagList, "")
+	if err != nil && this.spool != nil && isTransient(context.Background(), err) {
+		return "", this.spool.append(newSpoolRecord(spoolKindTopic, this.topicName, body, 0, tagList))
+	}
+	return msgId, err
 }
 
 func _publishMessage(client *CMQClient, topicName, msg string, tagList []string, routingKey string) (string, error) {
@@ -96,7 +179,30 @@ func _publishMessage(client *CMQClient, topicName, msg string, tagList []string,
 }
 
 func (this *Topic) BatchPublishMessage(msgList []string) ([]string, error) {
-	return _batchPublishMessage(this.client, this.topicName, msgList, nil, "")
+	return this.batchPublishMessage(msgList, nil)
+}
+
+func (this *Topic) batchPublishMessage(msgList []string, headers map[string]string) ([]string, error) {
+	bodys, err := this.codec.encodeAll(msgList, headers)
+	if err != nil {
+		return nil, err
+	}
+	if this.spool != nil && this.spool.pending() {
+		return nil, this.spoolAll(bodys)
+	}
+	msgIds, err := _batchPublishMessage(this.client, this.topicName, bodys, nil, "")
+	if err != nil && this.spool != nil && isTransient(context.Background(), err) {
+		return nil, this.spoolAll(bodys)
+	}
+	return msgIds, err
+}
+
+func (this *Topic) spoolAll(bodys []string) error {
+	records := make([]spoolRecord, len(bodys))
+	for i, body := range bodys {
+		records[i] = newSpoolRecord(spoolKindTopic, this.topicName, body, 0, nil)
+	}
+	return this.spool.append(records...)
 }
 
 func _batchPublishMessage(client *CMQClient, topicName string, msgList, tagList []string, routingKey string) (msgIds []string, err error) {
@@ -138,13 +244,13 @@ func (this *Topic) ListSubscription(offset, limit int, searchWord string) (total
 	param := make(map[string]string)
 	param["topicName"] = this.topicName
 	if searchWord != "" {
-		param["searchWord "] = searchWord
+		param["searchWord"] = searchWord
 	}
 	if offset >= 0 {
-		param["offset "] = strconv.Itoa(offset)
+		param["offset"] = strconv.Itoa(offset)
 	}
 	if limit > 0 {
-		param["limit "] = strconv.Itoa(limit)
+		param["limit"] = strconv.Itoa(limit)
 	}
 
 	var resp struct {